@@ -3,12 +3,16 @@ module vigor-dsl-signal-signal-stats
 go 1.22.0
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/gosnmp/gosnmp v1.42.1
 	go.oneofone.dev/gserv v1.1.0
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/gorilla/securecookie v1.1.2 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/vmihailenco/msgpack/v5 v5.4.1 // indirect
 	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	go.oneofone.dev/genh v0.0.0-20231018204829-f409a3fd4780 // indirect
@@ -17,6 +21,6 @@ require (
 	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/image v0.14.0 // indirect
 	golang.org/x/net v0.19.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/xerrors v0.0.0-20231012003039-104605ab7028 // indirect
 )
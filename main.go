@@ -2,50 +2,93 @@ package main
 
 import (
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/gosnmp/gosnmp"
 	"go.oneofone.dev/gserv"
+	"gopkg.in/yaml.v3"
 )
 
-const cacheDuration = 500 * time.Millisecond
-
-var cacheMutex sync.Mutex
-var cachedResponse gserv.Response
-var lastCacheTime time.Time
-
 var localizedFmt = message.NewPrinter(language.English)
 
 type oidPrefix string
 
 const (
-	AttenuationDb           oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.5"
-	OutputPowerDbm          oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.7"
-	CurrentSyncRateBps      oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.2"
-	MaxSyncRateBps          oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.8"
-	SnrMarginDb             oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.4"
-	InterleaveDepth         oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.10"
-	InterleaveDelayMs       oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.4"
-	ActualImpulseProtection oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.5"
-	IpAddressIfIndex        oidPrefix = ".1.3.6.1.2.1.4.20.1.2"
-	DownstreamDslStatus     oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.6"
-	IfOperStatus            oidPrefix = ".1.3.6.1.2.1.2.2.1.8"
-	IfInOctets              oidPrefix = ".1.3.6.1.2.1.2.2.1.10"
-	IfOutOctets             oidPrefix = ".1.3.6.1.2.1.2.2.1.16"
-	ChannelStatusNFec       oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.7"
-	ChannelStatusRFec       oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.8"
-	ChannelStatusLSymb      oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.9"
-	InterleaveBlock         oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.11"
+	AttenuationDb               oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.5"
+	OutputPowerDbm              oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.7"
+	CurrentSyncRateBps          oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.2"
+	MaxSyncRateBps              oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.8"
+	AttainableNetRateBps        oidPrefix = ".1.3.6.1.2.1.10.251.1.1.1.1.20"
+	ActualPsdTenthsDbmHz        oidPrefix = ".1.3.6.1.2.1.10.251.1.1.1.1.22"
+	ActualAtpTenthsDbm          oidPrefix = ".1.3.6.1.2.1.10.251.1.1.1.1.24"
+	SnrMarginDb                 oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.4"
+	InterleaveDepth             oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.10"
+	InterleaveDelayMs           oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.4"
+	ActualImpulseProtection     oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.5"
+	IpAddressIfIndex            oidPrefix = ".1.3.6.1.2.1.4.20.1.2"
+	DownstreamDslStatus         oidPrefix = ".1.3.6.1.2.1.10.94.1.1.2.1.6"
+	IfOperStatus                oidPrefix = ".1.3.6.1.2.1.2.2.1.8"
+	IfLastChange                oidPrefix = ".1.3.6.1.2.1.2.2.1.9"
+	SysUpTime                   oidPrefix = ".1.3.6.1.2.1.1.3"
+	SysDescr                    oidPrefix = ".1.3.6.1.2.1.1.1"
+	BandSnrMargin               oidPrefix = ".1.3.6.1.2.1.10.251.1.1.2.1.4"
+	SysName                     oidPrefix = ".1.3.6.1.2.1.1.5"
+	IfInOctets                  oidPrefix = ".1.3.6.1.2.1.2.2.1.10"
+	IfOutOctets                 oidPrefix = ".1.3.6.1.2.1.2.2.1.16"
+	IfHCInOctets                oidPrefix = ".1.3.6.1.2.1.31.1.1.1.6"
+	IfHCOutOctets               oidPrefix = ".1.3.6.1.2.1.31.1.1.1.10"
+	ChannelStatusNFec           oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.7"
+	ChannelStatusRFec           oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.8"
+	ChannelStatusLSymb          oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.9"
+	InterleaveBlock             oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.11"
+	ChannelStatusLPath          oidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.12"
+	ErroredSeconds              oidPrefix = ".1.3.6.1.2.1.10.251.1.4.1.1.1.14"
+	SeverelyErroredSeconds      oidPrefix = ".1.3.6.1.2.1.10.251.1.4.1.1.1.15"
+	CrcErrors                   oidPrefix = ".1.3.6.1.2.1.10.251.1.4.2.1.1.10"
+	ErroredSeconds15Min         oidPrefix = ".1.3.6.1.2.1.10.251.1.4.1.1.1.6"
+	SeverelyErroredSeconds15Min oidPrefix = ".1.3.6.1.2.1.10.251.1.4.1.1.1.7"
+	CrcErrors15Min              oidPrefix = ".1.3.6.1.2.1.10.251.1.4.2.1.1.5"
+	LineTransmissionSystem      oidPrefix = ".1.3.6.1.2.1.10.251.1.1.1.1.13"
+	LineProfile                 oidPrefix = ".1.3.6.1.2.1.10.251.1.1.1.1.26"
+	RateAdaptationMode          oidPrefix = ".1.3.6.1.2.1.10.251.1.5.2.1.1.6"
+	MaxInterleaveDelayMs        oidPrefix = ".1.3.6.1.2.1.10.251.1.5.3.1.1.10"
+	MinImpulseProtection        oidPrefix = ".1.3.6.1.2.1.10.251.1.5.3.1.1.12"
 )
 
 type oidMetadata struct {
@@ -54,6 +97,23 @@ type oidMetadata struct {
 	unit             string
 	fullOidTemplates []string
 	valueFormatter   func(interface{}) string
+	isCounter        bool
+	thresholds       *thresholds
+	// Left out of the HTML page when the modem doesn't return it, rather than shown as not supported
+	omitWhenAbsent bool
+	// Configured limit of the actual value under this prefix, shown next to it in the HTML page
+	limitOf oidPrefix
+	// Formatted and labelled in the unit selected with -rate-unit
+	isRate bool
+	// Shown as the Vectoring entry of the HTML page, from a -oids entry with the vectoring formatter
+	isVectoringState bool
+}
+
+// Values crossing warning or critical are highlighted in the HTML output. When critical is
+// below warning, lower values are worse (e.g. SNR margin), otherwise higher values are worse.
+type thresholds struct {
+	warning  int64
+	critical int64
 }
 
 func (o oidMetadata) withCustomOidTemplates(templates ...string) oidMetadata {
@@ -61,24 +121,134 @@ func (o oidMetadata) withCustomOidTemplates(templates ...string) oidMetadata {
 	return o
 }
 
+// Counters get the increase since the previous history sample displayed next to their value
+func (o oidMetadata) asCounter() oidMetadata {
+	o.isCounter = true
+	return o
+}
+
+func (o oidMetadata) omittedWhenAbsent() oidMetadata {
+	o.omitWhenAbsent = true
+	return o
+}
+
+func (o oidMetadata) asLimitOf(prefix oidPrefix) oidMetadata {
+	o.limitOf = prefix
+	return o
+}
+
+// Shown instead of notSupportedText when the modem doesn't have the OID
+func (o oidMetadata) withUnsupportedText(text string) oidMetadata {
+	valueFormatter := o.valueFormatter
+	o.valueFormatter = func(rawValue interface{}) string {
+		if rawValue == nil {
+			return text
+		}
+
+		return valueFormatter(rawValue)
+	}
+
+	return o
+}
+
+func (o oidMetadata) withThresholds(warning int64, critical int64) oidMetadata {
+	o.thresholds = &thresholds{warning: warning, critical: critical}
+	return o
+}
+
+// CSS class of the value, or "" when it is within bounds or the metric has no thresholds
+func (o oidMetadata) severity(rawValue interface{}) string {
+	if o.thresholds == nil {
+		return ""
+	}
+
+	value, castOk := toInt64(rawValue)
+	if !castOk {
+		return ""
+	}
+
+	exceeds := func(limit int64) bool {
+		if o.thresholds.critical < o.thresholds.warning {
+			return value < limit
+		}
+
+		return value > limit
+	}
+
+	if exceeds(o.thresholds.critical) {
+		return "critical"
+	} else if exceeds(o.thresholds.warning) {
+		return "warning"
+	}
+
+	return ""
+}
+
+// Description without the "(down/up)" hint, for outputs that carry the direction separately
+func (o oidMetadata) name() string {
+	return strings.TrimSuffix(o.description, " (down/up)")
+}
+
 func describeIntegerOid(prefix oidPrefix, description string, isDirectional bool, unit string) oidMetadata {
-	return describeFormattedIntegerOid(prefix, description, isDirectional, unit, func(i uint) string {
+	return describeFormattedIntegerOid(prefix, description, isDirectional, unit, func(i uint64) string {
 		return fmt.Sprintf("%d", i)
 	})
 }
 
-func describeFormattedIntegerOid(prefix oidPrefix, description string, isDirectional bool, unit string, valueFormatter func(uint) string) oidMetadata {
+// gosnmp decodes Integer as int, Counter32/Gauge32 as uint, TimeTicks as uint32 and Counter64 as uint64
+func toUint64(rawValue interface{}) (uint64, bool) {
+	switch value := rawValue.(type) {
+	case uint:
+		return uint64(value), true
+	case uint32:
+		return uint64(value), true
+	case uint64:
+		return value, true
+	case int:
+		return uint64(value), true
+	case int32:
+		return uint64(value), true
+	case int64:
+		return uint64(value), true
+	default:
+		return 0, false
+	}
+}
+
+// Unlike toUint64, keeps the sign of Integer values such as a negative SNR margin
+func toInt64(rawValue interface{}) (int64, bool) {
+	switch value := rawValue.(type) {
+	case int:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	default:
+		unsignedValue, castOk := toUint64(rawValue)
+		return int64(unsignedValue), castOk
+	}
+}
+
+func describeFormattedIntegerOid(prefix oidPrefix, description string, isDirectional bool, unit string, valueFormatter func(uint64) string) oidMetadata {
 	compositeTransformer := func(rawValue interface{}) string {
-		integerValue, castOk := rawValue.(uint)
-		if !castOk {
-			signedIntegerValue, castOk := rawValue.(int)
-			if castOk {
-				integerValue = uint(signedIntegerValue)
-			} else {
-				return fmt.Sprintf("(wrong type: %T)", rawValue)
+		if text, isAbsent := describeAbsentValue(rawValue); isAbsent {
+			return text
+		}
+
+		// Integer is signed, a negative SNR margin or output power would wrap around as a uint64
+		switch rawValue.(type) {
+		case int, int32, int64:
+			if signedValue, _ := toInt64(rawValue); signedValue < 0 {
+				return fmt.Sprintf("%d", signedValue)
 			}
 		}
 
+		integerValue, castOk := toUint64(rawValue)
+		if !castOk {
+			return fmt.Sprintf("(wrong type: %T)", rawValue)
+		}
+
 		return valueFormatter(integerValue)
 	}
 
@@ -103,292 +273,4455 @@ func describeFormattedIntegerOid(prefix oidPrefix, description string, isDirecti
 	}
 }
 
-var oidMetadataList = []oidMetadata{
-	{DownstreamDslStatus, "Sync status", "", []string{fmt.Sprintf("%s.{IfIndex}", DownstreamDslStatus)}, func(i interface{}) string {
-		value, castOk := i.([]uint8)
-		if !castOk {
-			return fmt.Sprintf("(wrong type: %T)", i)
-		}
+type rateUnit struct {
+	label    string
+	divisor  uint64
+	decimals int
+}
+
+var bpsRate = rateUnit{"bps", 1, 0}
+var kbpsRate = rateUnit{"Kbps", 1000, 0}
+var mbpsRate = rateUnit{"Mbps", 1000 * 1000, 2}
+
+var rateUnits = map[string]rateUnit{
+	"bps":  bpsRate,
+	"kbps": kbpsRate,
+	"mbps": mbpsRate,
+}
+
+func (u rateUnit) format(bps uint64) string {
+	if u.decimals == 0 {
+		return fmt.Sprintf("%d", bps/u.divisor)
+	}
+
+	return strconv.FormatFloat(float64(bps)/float64(u.divisor), 'f', u.decimals, 64)
+}
+
+// Special values of signed VDSL2-LINE-MIB status values given in tenths
+const tenthsNotAvailable = 2147483646
+const tenthsOutOfRange = 2147483647
+
+// Directional signed values indexed by ifIndex only, in tenths of unit
+func describeTenthsOid(prefix oidPrefix, description string, unit string, downstreamTemplate string, upstreamTemplate string) oidMetadata {
+	return oidMetadata{
+		oidPrefix:        prefix,
+		description:      description,
+		unit:             unit,
+		fullOidTemplates: []string{downstreamTemplate, upstreamTemplate},
+		valueFormatter: func(rawValue interface{}) string {
+			value, castOk := toInt64(rawValue)
+			if text, isAbsent := describeAbsentValue(rawValue); isAbsent {
+				return text
+			} else if castOk && (value == tenthsNotAvailable || value == tenthsOutOfRange) {
+				return notSupportedText
+			} else if !castOk {
+				return fmt.Sprintf("(wrong type: %T)", rawValue)
+			}
+
+			return fmt.Sprintf("%.1f", float64(value)/10)
+		},
+	}
+}
+
+// The unit label is set in main() once -rate-unit is parsed
+func describeRateOid(prefix oidPrefix, description string) oidMetadata {
+	metadata := describeFormattedIntegerOid(prefix, description, true, selectedRateUnit.label, func(bps uint64) string {
+		return selectedRateUnit.format(bps)
+	})
+	metadata.isRate = true
+
+	return metadata
+}
+
+// Applies -rate-unit to the rate formatters and their unit labels, false if name isn't one of rateUnits
+func selectRateUnit(name string) bool {
+	unit, found := rateUnits[strings.ToLower(name)]
+	if !found {
+		return false
+	}
 
-		var indexOfFirstNull = slices.Index(value, 0)
-		if indexOfFirstNull >= 0 {
-			value = value[:indexOfFirstNull]
+	selectedRateUnit = unit
+	for i := range oidMetadataList {
+		if oidMetadataList[i].isRate {
+			oidMetadataList[i].unit = unit.label
 		}
+	}
+
+	return true
+}
+
+// TimeTicks are hundredths of a second
+func formatTimeTicks(ticks uint64) string {
+	totalSeconds := ticks / 100
+	days := totalSeconds / 86400
+	hours := totalSeconds % 86400 / 3600
+	minutes := totalSeconds % 3600 / 60
+	seconds := totalSeconds % 60
+
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh %dm %ds", days, hours, minutes, seconds)
+	} else if hours > 0 {
+		return fmt.Sprintf("%dh %dm %ds", hours, minutes, seconds)
+	} else if minutes > 0 {
+		return fmt.Sprintf("%dm %ds", minutes, seconds)
+	}
+
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// Rendered for values of OIDs the modem doesn't support, which are nil (see isUnsupportedType)
+const notSupportedText = "(not supported)"
+
+// Initial value of every queried OID, left as is for those missing from the Get response
+type missingValue struct{}
+
+// Text of values the modem didn't report, common to all formatters
+func describeAbsentValue(rawValue interface{}) (string, bool) {
+	if rawValue == nil {
+		return notSupportedText, true
+	} else if _, isMissing := rawValue.(missingValue); isMissing {
+		return "(missing)", true
+	}
+
+	return "", false
+}
+
+// gosnmp returns these types with a nil value when the modem doesn't have the OID
+func isUnsupportedType(asnType gosnmp.Asn1BER) bool {
+	return asnType == gosnmp.NoSuchObject || asnType == gosnmp.NoSuchInstance || asnType == gosnmp.EndOfMibView
+}
+
+func describeOctetStringOid(prefix oidPrefix, description string, valueFormatter func([]uint8) string) oidMetadata {
+	return oidMetadata{
+		oidPrefix:        prefix,
+		description:      description,
+		fullOidTemplates: []string{"{Prefix}.{IfIndex}"},
+		valueFormatter: func(rawValue interface{}) string {
+			value, castOk := rawValue.([]uint8)
+			if text, isAbsent := describeAbsentValue(rawValue); isAbsent {
+				return text
+			} else if !castOk {
+				return fmt.Sprintf("(wrong type: %T)", rawValue)
+			}
+
+			return valueFormatter(value)
+		},
+	}
+}
 
-		return string(value)
-	}},
-	describeFormattedIntegerOid(IfOperStatus, "Interface status", false, "", func(i uint) string {
+var oidMetadataList = []oidMetadata{
+	describeOctetStringOid(DownstreamDslStatus, "Sync status", describeLineStatus),
+	describeOctetStringOid(LineTransmissionSystem, "Line standard", describeTransmissionSystem),
+	// xdsl2LineStatusActProfile
+	describeOctetStringOid(LineProfile, "VDSL2 profile", describeProfile),
+	describeFormattedIntegerOid(IfOperStatus, "Interface status", false, "", func(i uint64) string {
 		if i == 1 {
 			return "up"
 		} else {
 			return "down"
 		}
 	}),
+	describeFormattedIntegerOid(SysUpTime, "Modem uptime", false, "", formatTimeTicks).withCustomOidTemplates(
+		"{Prefix}.0"),
+	describeFormattedIntegerOid(IfLastChange, "Interface last change (after boot)", false, "", formatTimeTicks),
 	describeIntegerOid(AttenuationDb, "Attenuation (down/up)", true, "dB").withCustomOidTemplates(
 		".1.3.6.1.2.1.10.94.1.1.2.1.5.{IfIndex}",
-		".1.3.6.1.2.1.10.94.1.1.3.1.5.{IfIndex}"),
+		".1.3.6.1.2.1.10.94.1.1.3.1.5.{IfIndex}").withThresholds(40, 55),
+	// xdsl2LineStatusActPsdDs/Us, the average transmit PSD after power back-off (UPBO for upstream)
+	describeTenthsOid(ActualPsdTenthsDbmHz, "Transmit PSD (down/up)", "dBm/Hz",
+		".1.3.6.1.2.1.10.251.1.1.1.1.22.{IfIndex}",
+		".1.3.6.1.2.1.10.251.1.1.1.1.23.{IfIndex}"),
 	describeIntegerOid(OutputPowerDbm, "Output power (down/up)", true, "dBm").withCustomOidTemplates(
 		".1.3.6.1.2.1.10.94.1.1.2.1.7.{IfIndex}",
 		".1.3.6.1.2.1.10.94.1.1.3.1.7.{IfIndex}"),
-	describeFormattedIntegerOid(CurrentSyncRateBps, "Current rate (down/up)", true, "Kbps", func(i uint) string {
-		return fmt.Sprintf("%d", i/1000)
-	}),
-	describeFormattedIntegerOid(MaxSyncRateBps, "Max rate (down/up)", true, "Kbps", func(i uint) string {
-		return fmt.Sprintf("%d", i/1000)
-	}).withCustomOidTemplates(
+	// xdsl2LineStatusActAtpDs/Us, the aggregate transmit power actually used on the line
+	describeTenthsOid(ActualAtpTenthsDbm, "Aggregate TX power (down/up)", "dBm",
+		".1.3.6.1.2.1.10.251.1.1.1.1.24.{IfIndex}",
+		".1.3.6.1.2.1.10.251.1.1.1.1.25.{IfIndex}"),
+	describeRateOid(CurrentSyncRateBps, "Current rate (down/up)"),
+	describeRateOid(MaxSyncRateBps, "Max rate (down/up)").withCustomOidTemplates(
 		".1.3.6.1.2.1.10.94.1.1.2.1.8.{IfIndex}",
 		".1.3.6.1.2.1.10.94.1.1.3.1.8.{IfIndex}"),
+	// xdsl2LineStatusAttainableRateDs/Us, as reported by the DSLAM rather than estimated by the modem
+	describeRateOid(AttainableNetRateBps, "Attainable net data rate (down/up)").withCustomOidTemplates(
+		".1.3.6.1.2.1.10.251.1.1.1.1.20.{IfIndex}",
+		".1.3.6.1.2.1.10.251.1.1.1.1.21.{IfIndex}").withUnsupportedText("(not found)"),
 	describeIntegerOid(SnrMarginDb, "SNR margin (down/up)", true, "dB").withCustomOidTemplates(
 		".1.3.6.1.2.1.10.94.1.1.2.1.4.{IfIndex}",
-		".1.3.6.1.2.1.10.94.1.1.3.1.4.{IfIndex}"),
-	describeFormattedIntegerOid(InterleaveDepth, "Interleave depth (down/up)", true, "", func(i uint) string {
+		".1.3.6.1.2.1.10.94.1.1.3.1.4.{IfIndex}").withThresholds(6, 3),
+	// xdsl2LConfProfRaModeDs/Us of the line configuration profile, see findConfProfileIndexes
+	describeFormattedIntegerOid(RateAdaptationMode, "Rate adaptation mode (down/up)", true, "", describeRaMode).withCustomOidTemplates(
+		".1.3.6.1.2.1.10.251.1.5.2.1.1.6.{LineProfileIndex}",
+		".1.3.6.1.2.1.10.251.1.5.2.1.1.7.{LineProfileIndex}").omittedWhenAbsent(),
+	describeFormattedIntegerOid(InterleaveDepth, "Interleave depth (down/up)", true, "", func(i uint64) string {
 		if i == 1 {
 			return "Fast (1)"
 		}
 
 		return fmt.Sprintf("Interleaved (%d)", i)
 	}),
-	describeFormattedIntegerOid(InterleaveDelayMs, "Interleave delay (down/up)", true, "ms", func(i uint) string {
-		return fmt.Sprintf("0.%d", i)
-	}),
+	// xdsl2ChStatusActDelay, in whole milliseconds
+	describeIntegerOid(InterleaveDelayMs, "Interleave delay (down/up)", true, "ms"),
+	describeIntegerOid(ChannelStatusLPath, "Latency path (down/up)", true, ""),
 	describeIntegerOid(InterleaveBlock, "Interleave block (down/up)", true, ""),
 	describeIntegerOid(ActualImpulseProtection, "Impulse Protection (down/up)", true, "units"),
+	// xdsl2ChConfProfMaxDelayDs/Us and xdsl2ChConfProfMinProtectDs/Us of the first channel's
+	// configuration profile, see findConfProfileIndexes
+	describeFormattedIntegerOid(MaxInterleaveDelayMs, "Configured max interleave delay (down/up)", true, "ms", func(i uint64) string {
+		if i == 0 {
+			return "no limit"
+		}
+
+		return fmt.Sprintf("%d", i)
+	}).withCustomOidTemplates(
+		".1.3.6.1.2.1.10.251.1.5.3.1.1.10.{ChannelProfileIndex}",
+		".1.3.6.1.2.1.10.251.1.5.3.1.1.11.{ChannelProfileIndex}").omittedWhenAbsent().asLimitOf(InterleaveDelayMs),
+	describeFormattedIntegerOid(MinImpulseProtection, "Configured min impulse protection (down/up)", true, "symbols", describeSymbolProtection).withCustomOidTemplates(
+		".1.3.6.1.2.1.10.251.1.5.3.1.1.12.{ChannelProfileIndex}",
+		".1.3.6.1.2.1.10.251.1.5.3.1.1.13.{ChannelProfileIndex}").omittedWhenAbsent().asLimitOf(ActualImpulseProtection),
 	describeIntegerOid(ChannelStatusNFec, "Channel NFEC (down/up)", true, ""),
 	describeIntegerOid(ChannelStatusRFec, "Channel RFEC (down/up)", true, ""),
 	describeIntegerOid(ChannelStatusLSymb, "Channel LSymb (down/up)", true, ""),
-	describeFormattedIntegerOid(IfInOctets, "Traffic bytes (32-bit) (down/up)", true, "KiB", func(i uint) string {
+	// VDSL2-LINE-MIB has no counters since the last resync or since boot, only the current 15 minute
+	// and 1 day intervals, which restart on their own and when the modem reboots.
+	describeIntegerOid(ErroredSeconds15Min, "Errored seconds, current 15 min (down/up)", true, "s").asCounter(),
+	describeIntegerOid(SeverelyErroredSeconds15Min, "Severely errored seconds, current 15 min (down/up)", true, "s").asCounter(),
+	describeIntegerOid(CrcErrors15Min, "CRC errors, current 15 min (down/up)", true, "").asCounter(),
+	describeIntegerOid(ErroredSeconds, "Errored seconds, 1 day (down/up)", true, "s").asCounter(),
+	describeIntegerOid(SeverelyErroredSeconds, "Severely errored seconds, 1 day (down/up)", true, "s").asCounter(),
+	describeIntegerOid(CrcErrors, "CRC errors, 1 day (down/up)", true, "").asCounter(),
+	// G.INP retransmission counters (rtx-tx, rtx-c, rtx-uc), bitswap and SRA counters aren't part of
+	// VDSL2-LINE-MIB (RFC 5650), only of vendor MIBs and TR-069 data models, so they can't be listed
+	// here without a known OID. The same goes for the G.993.5 vectoring state, which has no standard
+	// MIB at all; a vendor OID for it can be added through -oids with the vectoring formatter.
+	describeFormattedIntegerOid(IfInOctets, "Traffic bytes (32-bit) (down/up)", true, "KiB", func(i uint64) string {
 		return localizedFmt.Sprintf("%d", i/1024)
 	}).withCustomOidTemplates(
 		string(IfInOctets)+".{IfIndex}",
-		string(IfOutOctets)+".{IfIndex}"),
+		string(IfOutOctets)+".{IfIndex}").asCounter(),
+	describeFormattedIntegerOid(IfHCInOctets, "Traffic bytes (64-bit) (down/up)", true, "KiB", func(i uint64) string {
+		return localizedFmt.Sprintf("%d", i/1024)
+	}).withCustomOidTemplates(
+		string(IfHCInOctets)+".{IfIndex}",
+		string(IfHCOutOctets)+".{IfIndex}").asCounter(),
 }
 
-const ifTypeMibPrefix = ".1.3.6.1.2.1.2.2.1.3"
-const vdsl2ChannelType = 251
-const terminationUnitOidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.1"
-const upstreamTerminationUnit = 1
-const downstreamTerminationUnit = 2
+// An entry of the -oids file, e.g. in YAML:
+//
+//   - prefix: .1.3.6.1.4.1.7367.1.2.3
+//     description: Vendor counter (down/up)
+//     directional: true
+//     formatter: divide
+//     divisor: 1000
+//     decimals: 1
+//     unit: K
+//
+// Directional OIDs are expanded like the built-in ones, i.e. {Prefix}.{IfIndex}.{DownstreamUnitId}
+// and {Prefix}.{IfIndex}.{UpstreamUnitId}, unless templates are given.
+type oidDefinition struct {
+	Prefix      string   `yaml:"prefix"`
+	Description string   `yaml:"description"`
+	Unit        string   `yaml:"unit"`
+	Directional bool     `yaml:"directional"`
+	Templates   []string `yaml:"templates"`
+	Counter     bool     `yaml:"counter"`
 
-var (
-	port      int
-	snmpIP    string
-	snmpPort  int
-	community string
-)
+	// integer (default), divide, timeticks, string or vectoring (see describeVectoringState)
+	Formatter string `yaml:"formatter"`
+	Divisor   uint64 `yaml:"divisor"`
+	Decimals  int    `yaml:"decimals"`
+}
 
-func main() {
-	flag.IntVar(&port, "p", 8080, "HTTP port")
-	flag.StringVar(&snmpIP, "ip", "127.0.0.1", "SNMP IP address")
-	flag.IntVar(&snmpPort, "port", 161, "SNMP port (default: 161)")
-	flag.StringVar(&community, "community", "public", "SNMP community name")
+var numericOidPattern = regexp.MustCompile(`^(\.[0-9]+)+$`)
 
-	flag.Parse()
+func loadOidDefinitions(path string) ([]oidMetadata, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-	if port > 65535 || port <= 0 {
-		panic("Invalid HTTP port")
+	// JSON is valid YAML, so both are accepted
+	var definitions []oidDefinition
+	err = yaml.Unmarshal(content, &definitions)
+	if err != nil {
+		return nil, err
 	}
 
-	start(port)
-}
+	var items []oidMetadata
+	for i, definition := range definitions {
+		item, err := definition.toOidMetadata()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d (%q): %w", i+1, definition.Description, err)
+		}
 
-func start(port int) {
-	srv := gserv.New()
-	svc := &Svc{
-		snmpClient: setupSnmp(),
+		for _, existing := range slices.Concat(oidMetadataList, items) {
+			if existing.oidPrefix == item.oidPrefix || existing.description == item.description {
+				return nil, fmt.Errorf("entry %d (%q): duplicate prefix or description", i+1, definition.Description)
+			}
+		}
+
+		items = append(items, item)
 	}
-	srv.GET("/", CreateCacheHandler(svc.HandleRequest))
 
-	fmt.Printf("Listening on port %d. Press CTRL+C to exit...\n", port)
-	log.Panic(srv.Run(context.Background(), "0.0.0.0:"+fmt.Sprintf("%d", port)))
+	return items, nil
 }
 
-type Svc struct {
-	snmpClient *gosnmp.GoSNMP
-}
+func (d oidDefinition) toOidMetadata() (oidMetadata, error) {
+	if !numericOidPattern.MatchString(d.Prefix) {
+		return oidMetadata{}, fmt.Errorf("prefix must be a numeric OID starting with a dot")
+	}
 
-func setupSnmp() *gosnmp.GoSNMP {
-	client := &gosnmp.GoSNMP{
-		Target:    snmpIP,
-		Port:      uint16(snmpPort),
-		Community: community,
-		Version:   gosnmp.Version2c,
-		Timeout:   time.Second * 5,
+	if d.Description == "" {
+		return oidMetadata{}, fmt.Errorf("description is required")
 	}
-	err := client.Connect()
-	if err != nil {
-		log.Fatalf("Failed to connect via SNMP: %v", err)
+
+	prefix := oidPrefix(d.Prefix)
+
+	var item oidMetadata
+	switch d.Formatter {
+	case "", "integer":
+		item = describeIntegerOid(prefix, d.Description, d.Directional, d.Unit)
+	case "divide":
+		if d.Divisor == 0 || d.Decimals < 0 {
+			return oidMetadata{}, fmt.Errorf("divide formatter requires a positive divisor")
+		}
+
+		item = describeFormattedIntegerOid(prefix, d.Description, d.Directional, d.Unit, rateUnit{d.Unit, d.Divisor, d.Decimals}.format)
+	case "timeticks":
+		item = describeFormattedIntegerOid(prefix, d.Description, d.Directional, d.Unit, formatTimeTicks)
+	case "vectoring":
+		item = describeFormattedIntegerOid(prefix, d.Description, d.Directional, d.Unit, describeVectoringState)
+		item.isVectoringState = true
+	case "string":
+		item = describeOctetStringOid(prefix, d.Description, octetString)
+		item.unit = d.Unit
+		if d.Directional && len(d.Templates) == 0 {
+			return oidMetadata{}, fmt.Errorf("directional string OIDs require templates")
+		}
+	default:
+		return oidMetadata{}, fmt.Errorf("unknown formatter %q", d.Formatter)
 	}
 
-	return client
-}
+	if len(d.Templates) > 0 {
+		if len(d.Templates) > 2 || (len(d.Templates) == 2) != d.Directional {
+			return oidMetadata{}, fmt.Errorf("directional OIDs need 2 templates, others 1")
+		}
 
-func findVdslIfIndex(client *gosnmp.GoSNMP) string {
-	ifTypes, err := client.BulkWalkAll(ifTypeMibPrefix)
-	if err != nil {
-		log.Fatalf("Failed to bulk walk ifTypes MIB: %v", err)
+		item = item.withCustomOidTemplates(d.Templates...)
+	}
+
+	if d.Counter {
+		item = item.asCounter()
 	}
 
-	for _, ifType := range ifTypes {
-		value, castOk := ifType.Value.(int)
+	return item, nil
+}
+
+// Bit ranges of the Xdsl2TransmissionModeType BITS in VDSL2-LINE-TC-MIB, bit 0 being the most significant bit of the first octet
+var transmissionSystemBitRanges = []struct {
+	firstBit int
+	lastBit  int
+	name     string
+}{
+	{0, 1, "ADSL (T1.413/ETSI)"},
+	{2, 7, "ADSL (G.992.1)"},
+	{8, 12, "ADSL Lite (G.992.2)"},
+	{16, 21, "ADSL2 (G.992.3)"},
+	{22, 23, "ADSL2 Lite (G.992.4)"},
+	{26, 29, "ADSL2 (G.992.3)"},
+	{30, 31, "ADSL2 Lite (G.992.4)"},
+	{32, 37, "ADSL2 (G.992.3)"},
+	{38, 49, "ADSL2+ (G.992.5)"},
+	{52, 54, "VDSL2 (G.993.2)"},
+}
+
+func describeTransmissionSystem(value []uint8) string {
+	var names []string
+	for _, bitRange := range transmissionSystemBitRanges {
+		for bit := bitRange.firstBit; bit <= bitRange.lastBit; bit++ {
+			if isBitSet(value, bit) {
+				if !slices.Contains(names, bitRange.name) {
+					names = append(names, bitRange.name)
+				}
 
-		if castOk && value == vdsl2ChannelType {
-			parts := strings.Split(ifType.Name, ".")
-			if len(parts) > 0 {
-				return parts[len(parts)-1]
+				break
 			}
 		}
 	}
 
-	log.Fatalf("Failed to find vdsl2 if index from snmp")
-	return ""
+	if len(names) == 0 {
+		return "(unknown)"
+	}
+
+	return strings.Join(names, ", ")
 }
 
-func findTerminationUnitIds(client *gosnmp.GoSNMP, vdslIfIndex string) (upstreamOidSuffix string, downstreamOidSuffix string) {
-	upstreamOid := fmt.Sprintf(
-		"%s.%s.%d", terminationUnitOidPrefix, vdslIfIndex, upstreamTerminationUnit)
+// BITS values start with the most significant bit of the first octet
+func isBitSet(value []uint8, bit int) bool {
+	return bit/8 < len(value) && value[bit/8]&(0x80>>(bit%8)) != 0
+}
 
-	downstreamOid := fmt.Sprintf(
-		"%s.%s.%d", terminationUnitOidPrefix, vdslIfIndex, downstreamTerminationUnit)
+// Bits of adslAtucCurrStatus in ADSL-LINE-MIB, bit 0 (noDefect) being the absence of the others
+var lineStatusBitNames = []string{
+	"noDefect",
+	"lossOfFraming",
+	"lossOfSignal",
+	"lossOfPower",
+	"lossOfSignalQuality",
+	"lossOfLink",
+	"dataInitFailure",
+	"configInitFailure",
+	"protocolInitFailure",
+	"noPeerAtuPresent",
+}
 
-	results, err := client.Get([]string{upstreamOid, downstreamOid})
-	if err != nil {
-		log.Fatalf("Failed to get downstream/upstream direction MIBs: %v", err)
+// The 10 status bits fit in 2 octets, longer values come from firmwares that report
+// a text state such as "SHOWTIME" instead and are shown as is.
+func describeLineStatus(value []uint8) string {
+	if len(value) > 2 {
+		return octetString(value)
 	}
 
-	for _, variable := range results.Variables {
-		value, castOk := variable.Value.(int)
-		if !castOk {
-			log.Fatalf("Failed to get downstream/upstream direction MIBs. Unexpected type")
-			return upstreamOidSuffix, downstreamOidSuffix
+	var names []string
+	for bit := 1; bit < len(lineStatusBitNames); bit++ {
+		if isBitSet(value, bit) {
+			names = append(names, lineStatusBitNames[bit])
 		}
+	}
 
-		if variable.Name == upstreamOid {
-			upstreamOidSuffix = fmt.Sprintf("%d", value)
-		}
+	if len(names) == 0 {
+		return lineStatusBitNames[0]
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// Bits of Xdsl2LineProfiles in VDSL2-LINE-TC-MIB (RFC 5650), bit 0 being the most significant bit of
+// the first octet. Profile 35b was added to VDSL2 after the MIB and has no bit in it.
+var profileBitNames = []string{"8a", "8b", "8c", "8d", "12a", "12b", "17a", "30a"}
 
-		if variable.Name == downstreamOid {
-			downstreamOidSuffix = fmt.Sprintf("%d", value)
+// Normally a single profile, but some modems report every enabled one
+func describeProfile(value []uint8) string {
+	var names []string
+	for bit, name := range profileBitNames {
+		if isBitSet(value, bit) {
+			names = append(names, name)
 		}
 	}
 
-	return upstreamOidSuffix, downstreamOidSuffix
+	if len(names) == 0 {
+		return "(profile unknown)"
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// G.993.5 vectoring has no standard MIB, vendor OIDs given with the vectoring formatter of -oids
+// are expected to report inactive(1), active(2) or friendly(3), i.e. vectoring with legacy lines
+func describeVectoringState(i uint64) string {
+	switch i {
+	case 1:
+		return "inactive"
+	case 2:
+		return "active"
+	case 3:
+		return "friendly"
+	default:
+		return fmt.Sprintf("unknown (%d)", i)
+	}
+}
+
+// Xdsl2RaMode in VDSL2-LINE-TC-MIB
+func describeRaMode(i uint64) string {
+	switch i {
+	case 1:
+		return "fixed (manual)"
+	case 2:
+		return "at init"
+	case 3:
+		return "dynamic (SRA)"
+	case 4:
+		return "dynamic with SOS"
+	default:
+		return fmt.Sprintf("unknown (%d)", i)
+	}
+}
+
+// Xdsl2SymbolProtection in VDSL2-LINE-TC-MIB, noProtection(1), halfSymbol(2), then singleSymbol(3)
+// to sixteenSymbols(18)
+func describeSymbolProtection(i uint64) string {
+	switch {
+	case i == 1:
+		return "0"
+	case i == 2:
+		return "0.5"
+	case i >= 3 && i <= 18:
+		return fmt.Sprintf("%d", i-2)
+	default:
+		return fmt.Sprintf("unknown (%d)", i)
+	}
 }
 
-func (s *Svc) HandleRequest(*gserv.Context) gserv.Response {
-	var html bytes.Buffer
+const ifTypeMibPrefix = ".1.3.6.1.2.1.2.2.1.3"
+const ifDescrMibPrefix = ".1.3.6.1.2.1.2.2.1.2"
+const vdsl2ChannelType = 251
+
+// Fallbacks for modems that expose the line with another ifType when not trained in VDSL2 mode
+var dslIfTypes = []int{vdsl2ChannelType, 97 /* vdsl */, 238 /* adsl2plus */, 230 /* adsl2 */, 94 /* adsl */}
+
+const terminationUnitOidPrefix = ".1.3.6.1.2.1.10.251.1.2.2.1.1"
+
+// xdsl2LineConfTemplate, the name of the line's row in xdsl2LineConfTemplateTable
+const lineConfTemplateOidPrefix = ".1.3.6.1.2.1.10.251.1.1.1.1.1"
+
+// xdsl2LConfTempLineProfile and xdsl2LConfTempChan1ConfProfile, indexed by template name
+const templateLineProfileOidPrefix = ".1.3.6.1.2.1.10.251.1.5.1.1.1.2"
+const templateChannelProfileOidPrefix = ".1.3.6.1.2.1.10.251.1.5.1.1.1.3"
+
+// ifStackStatus, indexed by the ifIndex of the higher layer interface then of the lower one
+const ifStackStatusOidPrefix = ".1.3.6.1.2.1.31.1.2.1.3"
+
+// Xdsl2Unit values reported by the termination unit OID. Vendors don't agree on the order of the
+// rows, so the direction is taken from these values rather than from the row suffix.
+const upstreamTerminationUnit = 1   // xtuc
+const downstreamTerminationUnit = 2 // xtur
+
+var (
+	port                  int
+	bindAddress           string
+	snmpIP                string
+	snmpPort              int
+	community             string
+	communities           []string // Split from community in main()
+	cacheDuration         time.Duration
+	snmpTimeout           time.Duration
+	snmpRetries           int
+	snmpMaxOidsPerRequest int
+	snmpMaxRepetitions    int
+	refreshSeconds        int
+	httpUser              string
+	httpPassword          string
+	tlsCertFile           string
+	tlsKeyFile            string
+	historySize           int
+	historyInterval       time.Duration
+	pinnedIfIndex         string
+	ifDescrPatternSource  string
+
+	allowCommunityOverride bool
+	allowTargetOverride    bool
+	discoveryAttempts      int
+	connectAttempts        int
+	warmUp                 bool
+	snmpTransport          string
+	snmpVersionName        string
+	snmpV3User             string
+	snmpV3AuthProtocolName string
+	snmpV3AuthPassphrase   string
+	snmpV3PrivProtocolName string
+	snmpV3PrivPassphrase   string
+	snmpV3ContextName      string
+
+	// Resolved from the names above in main()
+	snmpVersion        gosnmp.SnmpVersion
+	snmpV3AuthProtocol gosnmp.SnmpV3AuthProtocol
+	snmpV3PrivProtocol gosnmp.SnmpV3PrivProtocol
+	ifDescrPattern     *regexp.Regexp
+	snmpAddresses      []string
+	shownDirections    []int // Indexes in directionNames
+	checkOnly          bool
+	configFile         string
+	pushUrl            string
+	pushInterval       time.Duration
+	pushTimeout        time.Duration
+	requestTimeout     time.Duration
+	mqttBroker         string
+	mqttTopicPrefix    string
+	mqttInterval       time.Duration
+	oidsFile           string
+	graphiteAddress    string
+	graphiteInterval   time.Duration
+	graphitePrefix     string
+	rateUnitName       string
+	pageMode           string
+	socketPath         string
+	logRequests        bool
+	directionName      string
+	alertWebhookUrl    string
+	alertInterval      time.Duration
+	alertDebounce      time.Duration
+
+	// Resolved from rateUnitName in main()
+	selectedRateUnit = mbpsRate
+)
+
+func main() {
+	flag.IntVar(&port, "p", 8080, "HTTP port")
+	flag.StringVar(&bindAddress, "bind", "0.0.0.0", "HTTP listen IP address")
+	flag.StringVar(&socketPath, "socket", "", "Unix socket path to listen on instead of -bind and -p")
+	flag.StringVar(&snmpIP, "ip", "127.0.0.1", "SNMP IP address (comma-separated for multiple modems)")
+	flag.StringVar(&httpUser, "user", "", "HTTP basic auth user (empty to disable auth)")
+	flag.StringVar(&httpPassword, "pass", "", "HTTP basic auth password")
+	flag.StringVar(&tlsCertFile, "cert", "", "TLS certificate file (enables HTTPS together with -key)")
+	flag.StringVar(&tlsKeyFile, "key", "", "TLS private key file (enables HTTPS together with -cert)")
+	flag.IntVar(&snmpPort, "port", 161, "SNMP port (default: 161)")
+	flag.StringVar(&snmpTransport, "transport", "udp", "SNMP transport (udp or tcp)")
+	flag.StringVar(&community, "community", "public", "SNMP community name (comma-separated to try several in order, moving on to the next one after any failed read including timeouts)")
+	flag.StringVar(&snmpVersionName, "version", "2c", "SNMP version (1, 2c or 3)")
+	flag.StringVar(&snmpV3User, "v3-user", "", "SNMPv3 user name")
+	flag.StringVar(&snmpV3AuthProtocolName, "v3-auth-protocol", "", "SNMPv3 authentication protocol (MD5, SHA, SHA224, SHA256, SHA384 or SHA512, empty for none)")
+	flag.StringVar(&snmpV3AuthPassphrase, "v3-auth-pass", "", "SNMPv3 authentication passphrase")
+	flag.StringVar(&snmpV3PrivProtocolName, "v3-priv-protocol", "", "SNMPv3 privacy protocol (DES, AES, AES192, AES256, AES192C or AES256C, empty for none)")
+	flag.StringVar(&snmpV3PrivPassphrase, "v3-priv-pass", "", "SNMPv3 privacy passphrase")
+	flag.StringVar(&snmpV3ContextName, "context", "", "SNMPv3 context name (empty for the default context)")
+	flag.DurationVar(&snmpTimeout, "timeout", 5*time.Second, "SNMP request timeout")
+	flag.DurationVar(&requestTimeout, "request-timeout", 30*time.Second, "Maximum time spent on SNMP queries for one HTTP request, including discovery and reconnects")
+	flag.StringVar(&ifDescrPatternSource, "ifdescr", "", "Regular expression matching the ifDescr of the DSL interfaces, e.g. ^ptm0$ (default: match by ifType)")
+	flag.StringVar(&pinnedIfIndex, "ifindex", "", "ifIndex of the DSL interface to report (default: all DSL interfaces, VDSL2 first then by ascending ifIndex)")
+	flag.IntVar(&snmpRetries, "retries", 0, "SNMP request retries")
+	flag.IntVar(&snmpMaxOidsPerRequest, "max-oids", 20, "Maximum number of OIDs per SNMP Get request")
+	flag.IntVar(&snmpMaxRepetitions, "max-repetitions", 50, "GETBULK max-repetitions used to walk tables (1-255, ignored with SNMPv1)")
+	flag.IntVar(&refreshSeconds, "refresh", 1, "HTML page auto-refresh interval in seconds (0 to disable)")
+	flag.StringVar(&directionName, "direction", "both", "Directions of the directional metrics to query and show (both, down or up)")
+	flag.StringVar(&pageMode, "mode", "refresh", "HTML page auto-refresh mode (refresh to reload the whole page, ajax to update the values in place)")
+	flag.IntVar(&historySize, "history", 360, "Number of samples kept in the in-memory history (0 to disable)")
+	flag.DurationVar(&historyInterval, "history-interval", 10*time.Second, "Interval between history samples")
+	flag.DurationVar(&cacheDuration, "cache", 500*time.Millisecond, "Response cache duration (0 to disable)")
+	flag.IntVar(&discoveryAttempts, "discovery-attempts", 3, "Attempts for each SNMP query during interface discovery")
+	flag.IntVar(&connectAttempts, "connect-attempts", 10, "Attempts to connect via SNMP on startup before exiting")
+	flag.StringVar(&configFile, "config", "", "YAML file with option values keyed by flag name (flags given on the command line take precedence)")
+	flag.StringVar(&pushUrl, "push-url", "", "URL to POST the JSON metrics of every modem to periodically (empty to disable)")
+	flag.DurationVar(&pushInterval, "push-interval", time.Minute, "Interval between pushes to -push-url")
+	flag.DurationVar(&pushTimeout, "push-timeout", 10*time.Second, "Timeout of each push to -push-url")
+	flag.StringVar(&alertWebhookUrl, "alert-webhook", "", "URL to POST a JSON alert to when a metric crosses its critical threshold or the line resyncs (empty to disable)")
+	flag.DurationVar(&alertInterval, "alert-interval", time.Minute, "Interval between threshold checks for -alert-webhook")
+	flag.DurationVar(&alertDebounce, "alert-debounce", 15*time.Minute, "Minimum interval between two identical alerts")
+	flag.StringVar(&mqttBroker, "mqtt-broker", "", "MQTT broker URL to publish metrics to, e.g. tcp://192.168.1.2:1883 (empty to disable)")
+	flag.StringVar(&mqttTopicPrefix, "mqtt-topic", "vdsl", "MQTT topic prefix")
+	flag.DurationVar(&mqttInterval, "mqtt-interval", time.Minute, "Interval between MQTT publications")
+	flag.StringVar(&graphiteAddress, "graphite", "", "Graphite plaintext protocol host:port to send metrics to (empty to disable)")
+	flag.DurationVar(&graphiteInterval, "graphite-interval", time.Minute, "Interval between Graphite sends")
+	flag.StringVar(&graphitePrefix, "graphite-prefix", "vdsl", "Graphite metric path prefix")
+	flag.StringVar(&rateUnitName, "rate-unit", "mbps", "Unit of bit rates (bps, kbps or mbps)")
+	flag.StringVar(&oidsFile, "oids", "", "YAML or JSON file with additional OID definitions to report")
+	flag.BoolVar(&logRequests, "log-requests", false, "Log the method, path, status and duration of every HTTP request")
+	flag.BoolVar(&warmUp, "warmup", true, "Discover the DSL interfaces in the background at startup so the first request is fast")
+	flag.BoolVar(&checkOnly, "check", false, "Check connectivity and print which OIDs the modem returns, then exit (non-zero on failure)")
+	flag.BoolVar(&allowTargetOverride, "allow-target-override", false, "Allow querying any modem per request with ?ip=, ?port= and ?community=")
+	flag.BoolVar(&allowCommunityOverride, "allow-community-override", false, "Allow overriding the SNMP community per request with ?community= (for troubleshooting)")
 
-	html.WriteString("<!DOCTYPE html>")
+	flag.Parse()
 
-	//goland:noinspection SpellCheckingInspection
-	html.WriteString(`<html><head>
-  <meta http-equiv="refresh" content="1">
-  <title>VDSL Statistics</title></head><body><dl>`)
+	err := loadEnvironmentVariables()
+	if err != nil {
+		panic(fmt.Sprintf("Invalid environment variable: %v", err))
+	}
 
-	// Helper to add dt/dd entries
-	addEntry := func(dt, dd string) {
-		_, err := fmt.Fprintf(&html, "<dt>%s</dt><dd>%s</dd>", dt, strings.TrimSpace(dd))
+	if configFile != "" {
+		err = loadConfigFile(configFile)
 		if err != nil {
-			panic("Failed to append buffer")
+			panic(fmt.Sprintf("Invalid config file: %v", err))
 		}
 	}
 
-	vdslIfIndex := findVdslIfIndex(s.snmpClient)
-	xtucUpstreamSubId, xturDownstreamSubId := findTerminationUnitIds(s.snmpClient, vdslIfIndex)
-	ipAddress := findVdslPppAdress(s.snmpClient, vdslIfIndex)
-	addEntry("PPP IP Address", ipAddress)
-
-	fullOidsByOidPrefix := make(map[oidPrefix][]string)
-	valuesByQueryOids := make(map[string]interface{})
-	var queryOids []string
+	if port > 65535 || port <= 0 {
+		panic("Invalid HTTP port")
+	}
 
-	for _, item := range oidMetadataList {
-		var currentItemFullOids []string
+	if net.ParseIP(bindAddress) == nil {
+		panic("Invalid HTTP listen IP address")
+	}
 
-		for _, fullOidTemplate := range item.fullOidTemplates {
-			var fullOid = strings.Replace(fullOidTemplate, "{Prefix}", string(item.oidPrefix), 1)
-			fullOid = strings.Replace(fullOid, "{IfIndex}", vdslIfIndex, 1)
-			fullOid = strings.Replace(fullOid, "{DownstreamUnitId}", xturDownstreamSubId, 1)
-			fullOid = strings.Replace(fullOid, "{UpstreamUnitId}", xtucUpstreamSubId, 1)
-			valuesByQueryOids[fullOid] = ""
-			queryOids = append(queryOids, fullOid)
-			currentItemFullOids = append(currentItemFullOids, fullOid)
+	for _, address := range strings.Split(snmpIP, ",") {
+		parsedAddress, err := parseSnmpAddress(address)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid SNMP IP address %q: %v", address, err))
 		}
 
-		fullOidsByOidPrefix[item.oidPrefix] = currentItemFullOids
+		snmpAddresses = append(snmpAddresses, parsedAddress)
 	}
 
-	result, err := s.snmpClient.Get(queryOids)
-	if err != nil {
-		log.Printf("Error fetching all OIDs: %v", err)
-		addEntry("Status", "SNMP Error")
-	} else {
-		for _, v := range result.Variables {
-			valuesByQueryOids[v.Name] = v.Value
-		}
+	if httpUser == "" && httpPassword != "" {
+		panic("HTTP basic auth password given without a user")
 	}
 
-	for _, item := range oidMetadataList {
-		expectedFullOids := fullOidsByOidPrefix[item.oidPrefix]
-		if len(expectedFullOids) == 2 {
-			addEntry(
-				item.description,
-				fmt.Sprintf(
-					"%s / %s %s",
-					item.valueFormatter(valuesByQueryOids[expectedFullOids[0]]),
-					item.valueFormatter(valuesByQueryOids[expectedFullOids[1]]),
-					item.unit))
-		} else if len(expectedFullOids) == 1 {
-			addEntry(
-				item.description,
-				fmt.Sprintf(
-					"%s %s",
-					item.valueFormatter(valuesByQueryOids[expectedFullOids[0]]),
-					item.unit))
-		} else {
-			addEntry(item.description, "(error: unexpected oid count)")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		panic("Both -cert and -key must be given to enable HTTPS")
+	}
+
+	for _, file := range []string{tlsCertFile, tlsKeyFile} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			panic(fmt.Sprintf("Invalid TLS file: %v", err))
 		}
 	}
 
-	html.WriteString("</dl></body></html>")
+	if snmpTimeout <= 0 {
+		panic("Invalid SNMP timeout")
+	}
 
-	return gserv.PlainResponse("text/html", html.String())
-}
+	if requestTimeout <= 0 {
+		panic("Invalid request timeout")
+	}
 
-func findVdslPppAdress(client *gosnmp.GoSNMP, vdslIfIndex string) string {
-	result, err := client.WalkAll(string(IpAddressIfIndex))
-	if err != nil {
-		return fmt.Sprintf("(error: %v)", err)
+	if snmpRetries < 0 {
+		panic("Invalid SNMP retries")
 	}
 
-	for _, result := range result {
-		value, castOk := result.Value.(int)
-		if !castOk {
-			continue
-		}
+	if snmpMaxOidsPerRequest <= 0 || snmpMaxOidsPerRequest > gosnmp.MaxOids {
+		panic("Invalid maximum number of OIDs per SNMP request")
+	}
 
-		foundIfIndex := fmt.Sprintf("%d", value)
-		if foundIfIndex == vdslIfIndex {
-			ipAddress := strings.TrimPrefix(result.Name, fmt.Sprintf("%s.", string(IpAddressIfIndex)))
-			return ipAddress
-		}
+	// Larger responses than this are likely to exceed the UDP datagram size anyway
+	if snmpMaxRepetitions < 1 || snmpMaxRepetitions > 255 {
+		panic("Invalid GETBULK max-repetitions")
 	}
 
-	return fmt.Sprintf("(not found)")
-}
+	if refreshSeconds < 0 {
+		panic("Invalid refresh interval")
+	}
 
-func CreateCacheHandler(handler func(*gserv.Context) gserv.Response) func(*gserv.Context) gserv.Response {
-	return func(ctx *gserv.Context) gserv.Response {
-		cacheMutex.Lock()
-		defer cacheMutex.Unlock()
+	if pageMode != "refresh" && pageMode != "ajax" {
+		panic("Invalid page mode")
+	}
 
-		if time.Since(lastCacheTime) < cacheDuration && cachedResponse != nil {
-			return cachedResponse
-		}
+	if directionName == "both" {
+		shownDirections = []int{0, 1}
+	} else if direction := slices.Index(directionNames, directionName); direction >= 0 {
+		shownDirections = []int{direction}
+	} else {
+		panic("Invalid direction")
+	}
+
+	if historySize < 0 {
+		panic("Invalid history size")
+	}
+
+	if historyInterval <= 0 {
+		panic("Invalid history interval")
+	}
+
+	if cacheDuration < 0 {
+		panic("Invalid cache duration")
+	}
+
+	if discoveryAttempts < 1 {
+		panic("Invalid discovery attempts")
+	}
+
+	if connectAttempts < 1 {
+		panic("Invalid connect attempts")
+	}
+
+	if snmpTransport != "udp" && snmpTransport != "tcp" {
+		panic("Invalid SNMP transport")
+	}
 
-		newResponse := handler(ctx)
-		cachedResponse = newResponse
-		lastCacheTime = time.Now()
+	if ifDescrPatternSource != "" {
+		ifDescrPattern, err = regexp.Compile(ifDescrPatternSource)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid ifDescr pattern: %v", err))
+		}
+	}
+
+	communities = strings.Split(community, ",")
+	if slices.Contains(communities, "") {
+		panic("Invalid SNMP community")
+	}
+
+	var found bool
+	if snmpVersion, found = snmpVersions[snmpVersionName]; !found {
+		panic("Invalid SNMP version")
+	}
+
+	if snmpV3AuthProtocol, found = snmpV3AuthProtocols[strings.ToUpper(snmpV3AuthProtocolName)]; !found {
+		panic("Invalid SNMPv3 authentication protocol")
+	}
+
+	if snmpV3PrivProtocol, found = snmpV3PrivProtocols[strings.ToUpper(snmpV3PrivProtocolName)]; !found {
+		panic("Invalid SNMPv3 privacy protocol")
+	}
+
+	if snmpVersion == gosnmp.Version3 {
+		if snmpV3User == "" {
+			panic("Invalid SNMPv3 user")
+		}
+
+		if snmpV3AuthProtocol != gosnmp.NoAuth && snmpV3AuthPassphrase == "" {
+			panic("Invalid SNMPv3 authentication passphrase")
+		}
+
+		// USM doesn't allow privacy without authentication
+		if snmpV3PrivProtocol != gosnmp.NoPriv && (snmpV3AuthProtocol == gosnmp.NoAuth || snmpV3PrivPassphrase == "") {
+			panic("Invalid SNMPv3 privacy settings")
+		}
+	} else if snmpV3ContextName != "" {
+		panic("SNMP context name given without SNMPv3")
+	}
+
+	if pushUrl != "" {
+		parsedUrl, err := url.Parse(pushUrl)
+		if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+			panic("Invalid push URL")
+		}
+	}
+
+	if pushInterval <= 0 {
+		panic("Invalid push interval")
+	}
+
+	if pushTimeout <= 0 {
+		panic("Invalid push timeout")
+	}
+
+	if alertWebhookUrl != "" {
+		parsedUrl, err := url.Parse(alertWebhookUrl)
+		if err != nil || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+			panic("Invalid alert webhook URL")
+		}
+	}
+
+	if alertInterval <= 0 {
+		panic("Invalid alert interval")
+	}
+
+	if alertDebounce < 0 {
+		panic("Invalid alert debounce interval")
+	}
+
+	if mqttInterval <= 0 {
+		panic("Invalid MQTT interval")
+	}
+
+	mqttTopicPrefix = strings.TrimSuffix(mqttTopicPrefix, "/")
+	if mqttBroker != "" && mqttTopicPrefix == "" {
+		panic("Invalid MQTT topic prefix")
+	}
+
+	if graphiteAddress != "" {
+		_, _, err := net.SplitHostPort(graphiteAddress)
+		if err != nil {
+			panic("Invalid Graphite address")
+		}
+	}
+
+	if graphiteInterval <= 0 {
+		panic("Invalid Graphite interval")
+	}
+
+	graphitePrefix = strings.Trim(graphitePrefix, ".")
+	if graphiteAddress != "" && graphitePrefix == "" {
+		panic("Invalid Graphite prefix")
+	}
+
+	if !selectRateUnit(rateUnitName) {
+		panic("Invalid rate unit")
+	}
+
+	if oidsFile != "" {
+		definitions, err := loadOidDefinitions(oidsFile)
+		if err != nil {
+			panic(fmt.Sprintf("Invalid OID definitions file: %v", err))
+		}
+
+		oidMetadataList = append(oidMetadataList, definitions...)
+	}
+
+	if checkOnly {
+		if !check() {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	start(port)
+}
+
+// The config file is a flat YAML mapping from flag names to values, e.g.
+//
+//	ip: 192.168.1.1,192.168.2.1
+//	community: private
+//	history-interval: 30s
+//
+// Values are applied through the flags themselves so they get the same parsing, and flags
+// already given on the command line or through environment variables are left untouched.
+func loadConfigFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]string
+	err = yaml.Unmarshal(content, &values)
+	if err != nil {
+		return err
+	}
+
+	alreadySet := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		alreadySet[f.Name] = true
+	})
+
+	for name, value := range values {
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q", name)
+		}
+
+		if alreadySet[name] {
+			continue
+		}
+
+		err = flag.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("option %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Flags whose environment variable isn't simply VDSL_ followed by the upper-cased flag name
+var environmentVariablesByFlag = map[string]string{
+	"p":    "VDSL_HTTP_PORT",
+	"ip":   "VDSL_SNMP_IP",
+	"port": "VDSL_SNMP_PORT",
+}
+
+func environmentVariableName(flagName string) string {
+	if name, found := environmentVariablesByFlag[flagName]; found {
+		return name
+	}
+
+	return "VDSL_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Applied before the config file, so the precedence is command line > environment > config file > default
+func loadEnvironmentVariables() error {
+	givenOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		givenOnCommandLine[f.Name] = true
+	})
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, found := os.LookupEnv(environmentVariableName(f.Name))
+		if !found || givenOnCommandLine[f.Name] || err != nil {
+			return
+		}
+
+		err = flag.Set(f.Name, value)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", environmentVariableName(f.Name), err)
+		}
+	})
+
+	return err
+}
+
+func newSvc() *Svc {
+	svc := &Svc{}
+	for _, address := range snmpAddresses {
+		svc.targets = append(svc.targets, newSnmpTarget(address))
+	}
+
+	return svc
+}
+
+// Accepts IPv6 addresses with or without brackets (e.g. [fe80::1%eth0]), which gosnmp adds
+// itself when joining the address with the port
+func parseSnmpAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if strings.HasPrefix(address, "[") && strings.HasSuffix(address, "]") {
+		address = address[1 : len(address)-1]
+	}
+
+	parsedAddress, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", err
+	}
+
+	return parsedAddress.String(), nil
+}
+
+// Dry run for -check: one discovery and metrics read per target, reported on stdout.
+// Missing OIDs are only reported, failing discovery or the metrics Get fails the check.
+func check() bool {
+	svc := newSvc()
+	defer svc.close()
+
+	fmt.Printf("SNMP version %s, tables walked with %s\n", snmpVersionName, walkMethodName())
+
+	succeeded := true
+	for _, target := range svc.targets {
+		fmt.Printf("Modem %s\n", target.address)
+
+		reading := target.readMetrics(context.Background(), "")
+		if reading.discoveryErr != nil {
+			fmt.Printf("  FAIL discovery: %v\n", reading.discoveryErr)
+			succeeded = false
+			continue
+		}
+
+		fmt.Printf("  OK   interfaces: %s (reporting %s)\n", strings.Join(reading.allVdslIfIndexes, ", "), reading.vdslIfIndex)
+		fmt.Printf("  OK   PPP IP address: %s\n", reading.ipAddress)
+
+		if reading.err != nil {
+			fmt.Printf("  FAIL metrics: %v\n", reading.err)
+			succeeded = false
+			continue
+		}
+
+		for _, item := range oidMetadataList {
+			for _, fullOid := range shownFullOids(reading, item) {
+				rawValue := reading.valuesByQueryOids[fullOid]
+				asnType, found := reading.typesByQueryOids[fullOid]
+				if !found {
+					fmt.Printf("  MISS %s %s (not returned)\n", item.description, fullOid)
+					continue
+				} else if rawValue == nil {
+					fmt.Printf("  MISS %s %s (%s)\n", item.description, fullOid, asnType)
+					continue
+				}
+
+				formattedValue := item.valueFormatter(rawValue)
+				status := "OK  "
+				if strings.HasPrefix(formattedValue, "(wrong type") {
+					status = "TYPE"
+				}
+
+				fmt.Printf("  %s %s %s = %s\n", status, item.description, fullOid, formattedValue)
+			}
+		}
+	}
+
+	return succeeded
+}
+
+// Logs the request and turns panics into a 500, shared by every route
+func baseRoute(handler func(*gserv.Context) gserv.Response) func(*gserv.Context) gserv.Response {
+	return CreateRequestLogHandler(logRequests, CreateRecoverHandler(handler))
+}
+
+// Compressed and behind basic auth, with responses cached by cacheKey unless it is nil
+func route(handler func(*gserv.Context) gserv.Response, cacheKey func(*gserv.Context) string) func(*gserv.Context) gserv.Response {
+	if cacheKey != nil {
+		handler = CreateCacheHandler(cacheDuration, cacheKey, handler)
+	}
+
+	return baseRoute(CreateGzipHandler(CreateBasicAuthHandler(httpUser, httpPassword, handler)))
+}
+
+func start(port int) {
+	srv := gserv.New()
+	svc := newSvc()
+
+	srv.GET("/", route(svc.HandleRequest, svc.targetCacheKey))
+	srv.GET("/json", route(svc.HandleJsonRequest, svc.targetCacheKey))
+	srv.GET("/table.json", route(svc.HandleTableJsonRequest, svc.targetCacheKey))
+	srv.GET("/text", route(svc.HandleTextRequest, svc.targetCacheKey))
+	srv.GET("/metrics", route(svc.HandleMetricsRequest, metricsCacheKey))
+	srv.GET("/metrics-meta", route(HandleMetricsMetaRequest, nil))
+	srv.GET("/influx", route(svc.HandleInfluxRequest, svc.targetCacheKey))
+	srv.GET("/csv", route(svc.HandleCsvRequest, nil))
+	// Not compressed as gzip would hold back the samples until enough of them are buffered
+	srv.GET("/stream", baseRoute(CreateBasicAuthHandler(httpUser, httpPassword, svc.HandleStreamRequest)))
+	srv.GET("/history.json", route(svc.HandleHistoryRequest, nil))
+	srv.GET("/compact", route(svc.HandleCompactRequest, svc.targetCacheKey))
+	srv.GET("/raw", route(svc.HandleRawRequest, nil))
+	srv.GET("/debug", route(svc.HandleDebugRequest, nil))
+	// Left outside basic auth so browsers and probes without credentials (e.g. Kubernetes) work
+	srv.GET("/favicon.ico", baseRoute(HandleFaviconRequest))
+	srv.GET("/healthz", baseRoute(svc.HandleHealthRequest))
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if warmUp {
+		for _, target := range svc.targets {
+			go target.warmUp(ctx)
+		}
+	}
+
+	if historySize > 0 {
+		for _, target := range svc.targets {
+			go target.recordHistory(ctx, historyInterval)
+		}
+	}
+
+	if pushUrl != "" {
+		for _, target := range svc.targets {
+			go target.pushMetrics(ctx, pushUrl, pushInterval)
+		}
+	}
+
+	if alertWebhookUrl != "" {
+		for _, target := range svc.targets {
+			go target.sendAlerts(ctx, alertWebhookUrl, alertInterval, alertDebounce)
+		}
+	}
+
+	if mqttBroker != "" {
+		go svc.publishMqtt(ctx, mqttBroker, mqttInterval)
+	}
+
+	if graphiteAddress != "" {
+		go svc.sendGraphite(ctx, graphiteAddress, graphiteInterval)
+	}
+
+	listenAddress := net.JoinHostPort(bindAddress, fmt.Sprintf("%d", port))
+
+	var err error
+	if socketPath != "" {
+		fmt.Printf("Listening on unix socket %s. Press CTRL+C to exit...\n", socketPath)
+		err = runUnixSocket(ctx, srv, socketPath)
+	} else if tlsCertFile != "" {
+		fmt.Printf("Listening on %s (HTTPS). Press CTRL+C to exit...\n", listenAddress)
+		err = runTls(ctx, srv, listenAddress)
+	} else {
+		fmt.Printf("Listening on %s. Press CTRL+C to exit...\n", listenAddress)
+		err = srv.Run(ctx, listenAddress)
+	}
+
+	if ctx.Err() == nil {
+		log.Panic(err)
+	}
+
+	fmt.Println("Shutting down...")
+	svc.close()
+}
+
+// Done on CTRL+C or when systemd stops the service, which shuts the server down cleanly
+func shutdownContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func runTls(ctx context.Context, srv *gserv.Server, listenAddress string) error {
+	httpServer := &http.Server{
+		Addr:    listenAddress,
+		Handler: srv,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+
+	return httpServer.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+}
+
+// A socket file left behind by a crash would make listening fail, so it is replaced. The listener
+// removes the file again when the server is closed on shutdown.
+func runUnixSocket(ctx context.Context, srv *gserv.Server, socketPath string) error {
+	err := os.Remove(socketPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	httpServer := &http.Server{Handler: srv}
+
+	go func() {
+		<-ctx.Done()
+		_ = httpServer.Close()
+	}()
+
+	if tlsCertFile != "" {
+		return httpServer.ServeTLS(listener, tlsCertFile, tlsKeyFile)
+	}
+
+	return httpServer.Serve(listener)
+}
+
+const minReconnectBackoff = 500 * time.Millisecond
+const maxReconnectBackoff = 30 * time.Second
+const maxDiscoveryRetryBackoff = 5 * time.Second
+
+type Svc struct {
+	targets []*snmpTarget
+}
+
+// One modem and its SNMP sessions. snmpLock serializes a whole read (discovery included), the
+// sessions reconnect on connection errors by themselves and failed reads reconnect once more in
+// readMetrics with an exponential backoff.
+type snmpTarget struct {
+	address string
+	port    int
+
+	snmpLock         chan struct{}
+	session          *snmpSession
+	reconnectBackoff time.Duration
+
+	// All of -community for the modems given to -ip, only the requested one for throwaway targets.
+	// communityIndex is the one the sessions use, kept once a read succeeds with it. Guarded by snmpLock.
+	communities    []string
+	communityIndex int
+
+	// Readable without snmpLock so health checks don't wait behind a slow read.
+	lastReadSucceeded atomic.Bool
+
+	// Snapshot of the SNMP side for /debug, also readable without waiting behind a slow read.
+	statusMutex sync.Mutex
+	status      targetStatus
+
+	// Interface discovery is expensive and only changes when the line resyncs onto another
+	// interface, so it is kept until a metrics read fails. Guarded by snmpLock.
+	discovery []*discoveryResult
+
+	// The modem model never changes while it is up, so it is queried once. Guarded by snmpLock.
+	identity *systemIdentity
+
+	// Successful reads recorded by recordHistory, independently of HTTP requests.
+	history *metricsHistory
+
+	// gosnmp clients can't be shared between goroutines, so the PPP address walk
+	// which runs concurrently with the metrics Get gets its own connection.
+	addressSession *snmpSession
+}
+
+func (s *Svc) close() {
+	for _, target := range s.targets {
+		target.close()
+	}
+}
+
+func (t *snmpTarget) close() {
+	_ = t.lock(context.Background())
+	defer t.unlock()
+
+	t.session.close()
+	t.addressSession.close()
+}
+
+// Waiting for another read, e.g. a poller going through reconnect backoffs, is abandoned once ctx
+// is done so HTTP requests stay bounded by -request-timeout
+func (t *snmpTarget) lock(ctx context.Context) error {
+	select {
+	case t.snmpLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *snmpTarget) unlock() {
+	<-t.snmpLock
+}
+
+func newSnmpTarget(address string) *snmpTarget {
+	target := &snmpTarget{
+		address:          address,
+		port:             snmpPort,
+		communities:      communities,
+		snmpLock:         make(chan struct{}, 1),
+		session:          setupSnmp(address),
+		addressSession:   setupSnmp(address),
+		reconnectBackoff: minReconnectBackoff,
+		history:          newMetricsHistory(historySize),
+	}
+	target.lastReadSucceeded.Store(true)
+
+	return target
+}
+
+// Used for a single request with ?community=, the caller must close it. Keeps no history.
+func newThrowawaySnmpTarget(address string, port int, community string) (*snmpTarget, error) {
+	target := &snmpTarget{
+		address:          address,
+		port:             port,
+		communities:      []string{community},
+		snmpLock:         make(chan struct{}, 1),
+		reconnectBackoff: minReconnectBackoff,
+		history:          newMetricsHistory(0),
+	}
+
+	var err error
+	target.session, err = newSnmpSession(gosnmpConnector(address, port, community))
+	if err != nil {
+		return nil, err
+	}
+
+	target.addressSession, err = newSnmpSession(gosnmpConnector(address, port, community))
+	if err != nil {
+		target.session.close()
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// Retried so the service survives being started before the modem is reachable (e.g. after a power blip)
+func setupSnmp(address string) *snmpSession {
+	backoff := minReconnectBackoff
+
+	session, err := newSnmpSession(gosnmpConnector(address, snmpPort, communities[0]))
+	for attempt := 1; err != nil && attempt < connectAttempts; attempt++ {
+		log.Printf("Failed to connect via SNMP to %s (attempt %d of %d), retrying in %v: %v",
+			address, attempt, connectAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxReconnectBackoff)
+
+		session, err = newSnmpSession(gosnmpConnector(address, snmpPort, communities[0]))
+	}
+
+	if err != nil {
+		log.Fatalf("Failed to connect via SNMP to %s: %v", address, err)
+	}
+
+	return session
+}
+
+var snmpVersions = map[string]gosnmp.SnmpVersion{
+	"1":  gosnmp.Version1,
+	"2c": gosnmp.Version2c,
+	"3":  gosnmp.Version3,
+}
+
+var snmpV3AuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"":       gosnmp.NoAuth,
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+var snmpV3PrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"":        gosnmp.NoPriv,
+	"DES":     gosnmp.DES,
+	"AES":     gosnmp.AES,
+	"AES192":  gosnmp.AES192,
+	"AES256":  gosnmp.AES256,
+	"AES192C": gosnmp.AES192C,
+	"AES256C": gosnmp.AES256C,
+}
+
+func connectSnmp(address string, port int, community string) (*gosnmp.GoSNMP, error) {
+	client := &gosnmp.GoSNMP{
+		Target:         address,
+		Port:           uint16(port),
+		Transport:      snmpTransport,
+		Community:      community,
+		Version:        snmpVersion,
+		Timeout:        snmpTimeout,
+		Retries:        snmpRetries,
+		MaxRepetitions: uint32(snmpMaxRepetitions),
+	}
+
+	if snmpVersion == gosnmp.Version3 {
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.MsgFlags = gosnmp.NoAuthNoPriv
+		if snmpV3PrivProtocol != gosnmp.NoPriv {
+			client.MsgFlags = gosnmp.AuthPriv
+		} else if snmpV3AuthProtocol != gosnmp.NoAuth {
+			client.MsgFlags = gosnmp.AuthNoPriv
+		}
+
+		// Each client gets its own parameters as gosnmp stores the discovered engine state in them
+		client.SecurityParameters = &gosnmp.UsmSecurityParameters{
+			UserName:                 snmpV3User,
+			AuthenticationProtocol:   snmpV3AuthProtocol,
+			AuthenticationPassphrase: snmpV3AuthPassphrase,
+			PrivacyProtocol:          snmpV3PrivProtocol,
+			PrivacyPassphrase:        snmpV3PrivPassphrase,
+		}
+		client.ContextName = snmpV3ContextName
+	}
+
+	return client, client.Connect()
+}
+
+// The parts of *gosnmp.GoSNMP used by discovery and reads, so they can run against a fake agent
+type snmpGetter interface {
+	Get(oids []string) (*gosnmp.SnmpPacket, error)
+}
+
+type snmpWalker interface {
+	WalkAll(rootOid string) ([]gosnmp.SnmpPDU, error)
+	BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error)
+}
+
+// The parts of *gosnmp.GoSNMP used by snmpSession, so it can run against a fake agent
+type snmpClient interface {
+	snmpGetter
+	snmpWalker
+	Close() error
+}
+
+// Wraps one SNMP client, serializing its queries and transparently reconnecting once when a query
+// fails on a connection error, e.g. after the modem restarted its agent and dropped the socket.
+type snmpSession struct {
+	mutex  sync.Mutex
+	client snmpClient
+
+	// Builds the client again on reconnects. Guarded by mutex.
+	connect func() (snmpClient, error)
+
+	// Applied to every client built by connect. Guarded by mutex.
+	ctx context.Context
+}
+
+func newSnmpSession(connect func() (snmpClient, error)) (*snmpSession, error) {
+	client, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return &snmpSession{client: client, connect: connect, ctx: context.Background()}, nil
+}
+
+func gosnmpConnector(address string, port int, community string) func() (snmpClient, error) {
+	return func() (snmpClient, error) {
+		client, err := connectSnmp(address, port, community)
+		if err != nil {
+			return nil, err
+		}
+
+		return client, nil
+	}
+}
+
+func (s *snmpSession) Get(oids []string) (*gosnmp.SnmpPacket, error) {
+	return withReconnect(s, func(client snmpClient) (*gosnmp.SnmpPacket, error) {
+		return client.Get(oids)
+	})
+}
+
+func (s *snmpSession) WalkAll(rootOid string) ([]gosnmp.SnmpPDU, error) {
+	return withReconnect(s, func(client snmpClient) ([]gosnmp.SnmpPDU, error) {
+		return client.WalkAll(rootOid)
+	})
+}
+
+func (s *snmpSession) BulkWalkAll(rootOid string) ([]gosnmp.SnmpPDU, error) {
+	return withReconnect(s, func(client snmpClient) ([]gosnmp.SnmpPDU, error) {
+		return client.BulkWalkAll(rootOid)
+	})
+}
+
+func withReconnect[T any](s *snmpSession, query func(snmpClient) (T, error)) (T, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Left without a client by a failed reconnect
+	if s.client == nil {
+		err := s.reconnectLocked()
+		if err != nil {
+			var none T
+			return none, err
+		}
+	}
+
+	result, err := query(s.client)
+	if err == nil || !isConnectionError(err) {
+		return result, err
+	}
+
+	log.Printf("SNMP connection error, reconnecting: %v", err)
+	err = s.reconnectLocked()
+	if err != nil {
+		return result, err
+	}
+
+	return query(s.client)
+}
+
+// Errors of the socket itself, such as ECONNREFUSED once the agent dropped it. Timeouts aren't
+// included, a modem that doesn't answer at all is reconnected with a backoff by readMetrics instead.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return !opErr.Timeout()
+	}
+
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF)
+}
+
+// Replaces the client with a new one built by connect, which is also used by later reconnects
+func (s *snmpSession) reconnect(connect func() (snmpClient, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.connect = connect
+
+	return s.reconnectLocked()
+}
+
+// Must be called with mutex held.
+func (s *snmpSession) reconnectLocked() error {
+	if s.client != nil {
+		_ = s.client.Close()
+		s.client = nil
+	}
+
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	s.client = client
+	s.applyContext()
+
+	return nil
+}
+
+// Queries are abandoned once ctx is done, until the returned function is called.
+func (s *snmpSession) useContext(ctx context.Context) func() {
+	s.setContext(ctx)
+
+	return func() {
+		s.setContext(context.Background())
+	}
+}
+
+func (s *snmpSession) setContext(ctx context.Context) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ctx = ctx
+	s.applyContext()
+}
+
+// Clients other than gosnmp that abandon their queries once ctx is done, e.g. the fakes used in tests
+type contextClient interface {
+	setContext(ctx context.Context)
+}
+
+// Must be called with mutex held.
+func (s *snmpSession) applyContext() {
+	switch client := s.client.(type) {
+	case *gosnmp.GoSNMP:
+		client.Context = s.ctx
+	case contextClient:
+		client.setContext(s.ctx)
+	}
+}
+
+func (s *snmpSession) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != nil {
+		_ = s.client.Close()
+		s.client = nil
+	}
+}
+
+// SNMPv1 has no GETBULK, so tables are walked with one GETNEXT per row instead
+func walkAll(client snmpWalker, rootOid string) ([]gosnmp.SnmpPDU, error) {
+	if snmpVersion == gosnmp.Version1 {
+		return client.WalkAll(rootOid)
+	}
+
+	return client.BulkWalkAll(rootOid)
+}
+
+func walkMethodName() string {
+	if snmpVersion == gosnmp.Version1 {
+		return "WalkAll (GETNEXT)"
+	}
+
+	return "BulkWalkAll (GETBULK)"
+}
+
+// Must be called with snmpLock held. The backoff doubles on every consecutive failed read
+// so a modem that is down for a while doesn't get hammered with reconnects.
+func (t *snmpTarget) reconnectSnmp(ctx context.Context) error {
+	log.Printf("Reconnecting via SNMP to %s in %v", t.address, t.reconnectBackoff)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(t.reconnectBackoff):
+	}
+
+	// Agents don't answer requests with a wrong community at all, so a failed read can't be
+	// told apart from an unreachable modem and simply moves on to the next community.
+	if len(t.communities) > 1 {
+		t.communityIndex = (t.communityIndex + 1) % len(t.communities)
+	}
+
+	for _, session := range []*snmpSession{t.session, t.addressSession} {
+		err := session.reconnect(gosnmpConnector(t.address, t.port, t.communities[t.communityIndex]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Modems that just resynced or are still booting often time out on the first discovery queries,
+// so each one is retried up to discoveryAttempts times with an exponential backoff. Waiting for
+// the next attempt stops once ctx is done, e.g. at the -request-timeout deadline.
+func withDiscoveryRetries[T any](ctx context.Context, query func() (T, error)) (T, error) {
+	backoff := minReconnectBackoff
+
+	result, err := query()
+	for attempt := 1; err != nil && !isContextError(err) && attempt < discoveryAttempts; attempt++ {
+		log.Printf("Discovery query failed, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxDiscoveryRetryBackoff)
+
+		result, err = query()
+	}
+
+	return result, err
+}
+
+// gosnmp returns the error of the client's Context as is once it is done
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Typical right after a modem reboot, until the line syncs and the DSL interface shows up
+var errNoDslInterface = errors.New("failed to find xdsl if index from snmp")
+
+// Interfaces are ordered by ifType as listed in dslIfTypes (VDSL2 first), then by ascending ifIndex
+func findVdslIfIndexes(ctx context.Context, client snmpWalker) ([]string, error) {
+	ifTypes, err := withDiscoveryRetries(ctx, func() ([]gosnmp.SnmpPDU, error) {
+		return walkAll(client, ifTypeMibPrefix)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bulk walk ifTypes MIB: %w", err)
+	}
+
+	var ifIndexes []string
+	for _, dslIfType := range dslIfTypes {
+		for _, ifType := range ifTypes {
+			value, castOk := ifType.Value.(int)
+
+			if castOk && value == dslIfType {
+				parts := strings.Split(ifType.Name, ".")
+				if len(parts) > 0 {
+					ifIndexes = append(ifIndexes, parts[len(parts)-1])
+				}
+			}
+		}
+	}
+
+	if len(ifIndexes) == 0 {
+		return nil, errNoDslInterface
+	}
+
+	return ifIndexes, nil
+}
+
+// For modems where the DSL interface is known by name (e.g. dsl0 or ptm0) rather than by ifType,
+// such as those with several interfaces of a DSL ifType. Interfaces are ordered by ascending ifIndex.
+func findIfIndexesByDescr(ctx context.Context, client snmpWalker, pattern *regexp.Regexp) ([]string, error) {
+	ifDescrs, err := withDiscoveryRetries(ctx, func() ([]gosnmp.SnmpPDU, error) {
+		return walkAll(client, ifDescrMibPrefix)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bulk walk ifDescr MIB: %w", err)
+	}
+
+	var ifIndexes []string
+	for _, ifDescr := range ifDescrs {
+		value, castOk := ifDescr.Value.([]uint8)
+		if castOk && pattern.MatchString(octetString(value)) {
+			parts := strings.Split(ifDescr.Name, ".")
+			ifIndexes = append(ifIndexes, parts[len(parts)-1])
+		}
+	}
+
+	if len(ifIndexes) == 0 {
+		return nil, errNoDslInterface
+	}
+
+	return ifIndexes, nil
+}
+
+func findTerminationUnitIds(ctx context.Context, client snmpWalker, vdslIfIndex string) (upstreamOidSuffix string, downstreamOidSuffix string, err error) {
+	unitsBySuffix, err := withDiscoveryRetries(ctx, func() (map[string]interface{}, error) {
+		return walkUnderIfIndex(client, terminationUnitOidPrefix, vdslIfIndex)
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get downstream/upstream direction MIBs: %w", err)
+	}
+
+	for suffix, unit := range unitsBySuffix {
+		value, castOk := unit.(int)
+		if !castOk {
+			return "", "", fmt.Errorf("failed to get downstream/upstream direction MIBs: unexpected type %T", unit)
+		}
+
+		switch value {
+		case upstreamTerminationUnit:
+			upstreamOidSuffix = suffix
+		case downstreamTerminationUnit:
+			downstreamOidSuffix = suffix
+		}
+	}
+
+	if upstreamOidSuffix == "" || downstreamOidSuffix == "" {
+		return "", "", fmt.Errorf(
+			"failed to get downstream/upstream direction MIBs: expected both units, got %v", unitsBySuffix)
+	}
+
+	return upstreamOidSuffix, downstreamOidSuffix, nil
+}
+
+// The configuration profiles are indexed by name rather than ifIndex. The line's xdsl2LineConfTemplate
+// names its row in the template table, which in turn names the line profile and the channel profile
+// of the first bearer channel. Both indexes are empty when the modem doesn't expose the template.
+func findConfProfileIndexes(client snmpGetter, vdslIfIndex string) (lineProfileIndex string, channelProfileIndex string, err error) {
+	result, err := client.Get([]string{lineConfTemplateOidPrefix + "." + vdslIfIndex})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get the line configuration template: %w", err)
+	}
+
+	templateName := octetStringValue(result.Variables, lineConfTemplateOidPrefix+"."+vdslIfIndex)
+	if templateName == "" {
+		return "", "", nil
+	}
+
+	templateIndex := stringOidIndex(templateName)
+	result, err = client.Get([]string{
+		templateLineProfileOidPrefix + templateIndex,
+		templateChannelProfileOidPrefix + templateIndex,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get the profiles of template %q: %w", templateName, err)
+	}
+
+	if lineProfile := octetStringValue(result.Variables, templateLineProfileOidPrefix+templateIndex); lineProfile != "" {
+		lineProfileIndex = strings.TrimPrefix(stringOidIndex(lineProfile), ".")
+	}
+
+	if channelProfile := octetStringValue(result.Variables, templateChannelProfileOidPrefix+templateIndex); channelProfile != "" {
+		channelProfileIndex = strings.TrimPrefix(stringOidIndex(channelProfile), ".")
+	}
+
+	return lineProfileIndex, channelProfileIndex, nil
+}
+
+// The value of the varbind named oid if it is a non-empty octet string, "" otherwise
+func octetStringValue(variables []gosnmp.SnmpPDU, oid string) string {
+	for _, variable := range variables {
+		if value, castOk := variable.Value.([]uint8); castOk && variable.Name == oid {
+			return string(value)
+		}
+	}
+
+	return ""
+}
+
+// SnmpAdminString table indexes are the length of the string followed by its bytes, e.g. ".3.68.83.76"
+func stringOidIndex(value string) string {
+	var index strings.Builder
+	_, _ = fmt.Fprintf(&index, ".%d", len(value))
+	for _, character := range []byte(value) {
+		_, _ = fmt.Fprintf(&index, ".%d", character)
+	}
+
+	return index.String()
+}
+
+// A row of xdsl2ChannelStatusTable, i.e. a bearer channel and the latency path (0 to 3) it is mapped to
+type latencyPath struct {
+	// The index of the row, {ChannelIfIndex}.{UnitId}
+	channelIndex string
+	number       uint64
+}
+
+// Read for each path of lines with several latency paths in a direction
+var perPathOidPrefixes = []oidPrefix{CurrentSyncRateBps, ActualImpulseProtection, InterleaveDelayMs}
+
+const latencyPathOidTemplate = "{Prefix}.{ChannelIndex}"
+
+func (p latencyPath) fullOid(prefix oidPrefix) string {
+	return expandOidTemplate(latencyPathOidTemplate, map[string]string{
+		"Prefix":       string(prefix),
+		"ChannelIndex": p.channelIndex,
+	})
+}
+
+// Replaces the {Name} placeholders of an OID template, e.g. {Prefix}, {IfIndex} or {DownstreamUnitId}
+func expandOidTemplate(template string, placeholders map[string]string) string {
+	for name, value := range placeholders {
+		template = strings.ReplaceAll(template, "{"+name+"}", value)
+	}
+
+	return template
+}
+
+// The channel table rows of a line are under the line's own ifIndex on most modems, and under the
+// bearer channel interfaces stacked on top of the line in ifStackTable on others. Paths are sorted
+// by number within each direction.
+func findLatencyPaths(client snmpWalker, vdslIfIndex string, xtucUpstreamSubId string, xturDownstreamSubId string) ([2][]latencyPath, error) {
+	var paths [2][]latencyPath
+
+	stackEntries, err := walkAll(client, ifStackStatusOidPrefix)
+	if err != nil {
+		return paths, fmt.Errorf("failed to walk ifStackTable: %w", err)
+	}
+
+	channelIfIndexes := []string{vdslIfIndex}
+	for _, stackEntry := range stackEntries {
+		parts := strings.Split(stackEntry.Name, ".")
+		if len(parts) < 2 {
+			continue
+		}
+
+		higherIfIndex, lowerIfIndex := parts[len(parts)-2], parts[len(parts)-1]
+		if lowerIfIndex == vdslIfIndex && higherIfIndex != "0" && !slices.Contains(channelIfIndexes, higherIfIndex) {
+			channelIfIndexes = append(channelIfIndexes, higherIfIndex)
+		}
+	}
+
+	for _, channelIfIndex := range channelIfIndexes {
+		pathNumbersByUnitId, err := walkUnderIfIndex(client, ChannelStatusLPath, channelIfIndex)
+		if err != nil {
+			return [2][]latencyPath{}, fmt.Errorf("failed to walk the latency paths of interface %s: %w", channelIfIndex, err)
+		}
+
+		for unitId, pathNumber := range pathNumbersByUnitId {
+			number, castOk := toUint64(pathNumber)
+			if !castOk {
+				continue
+			}
+
+			path := latencyPath{channelIndex: channelIfIndex + "." + unitId, number: number}
+			switch unitId {
+			case xturDownstreamSubId:
+				paths[0] = append(paths[0], path)
+			case xtucUpstreamSubId:
+				paths[1] = append(paths[1], path)
+			}
+		}
+	}
+
+	for _, directionPaths := range paths {
+		slices.SortFunc(directionPaths, func(a, b latencyPath) int {
+			if a.number != b.number {
+				return cmp.Compare(a.number, b.number)
+			}
+
+			return strings.Compare(a.channelIndex, b.channelIndex)
+		})
+	}
+
+	return paths, nil
+}
+
+// Fixed size ring buffer of successful reads, oldest sample being overwritten first
+type metricsHistory struct {
+	mutex   sync.Mutex
+	samples []metricsReading
+	next    int
+}
+
+func newMetricsHistory(size int) *metricsHistory {
+	return &metricsHistory{samples: make([]metricsReading, 0, size)}
+}
+
+func (h *metricsHistory) add(reading metricsReading) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.samples) < cap(h.samples) {
+		h.samples = append(h.samples, reading)
+		return
+	}
+
+	if len(h.samples) > 0 {
+		h.samples[h.next] = reading
+		h.next = (h.next + 1) % len(h.samples)
+	}
+}
+
+// Returns the samples oldest first
+func (h *metricsHistory) snapshot() []metricsReading {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	samples := make([]metricsReading, 0, len(h.samples))
+	samples = append(samples, h.samples[h.next:]...)
+	samples = append(samples, h.samples[:h.next]...)
+
+	return samples
+}
+
+func (h *metricsHistory) lastTwo() (previous metricsReading, latest metricsReading, found bool) {
+	samples := h.snapshot()
+	if len(samples) < 2 {
+		return previous, latest, false
+	}
+
+	return samples[len(samples)-2], samples[len(samples)-1], true
+}
+
+// A counter lower than its previous value has been reset or has wrapped, in which
+// case everything it counted since then is the increase. Counter64 values only wrap
+// after having been close to the maximum, otherwise they have been reset.
+func counterDelta(previousValue interface{}, latestValue interface{}) (uint64, bool) {
+	previous, previousOk := toUint64(previousValue)
+	latest, latestOk := toUint64(latestValue)
+	if !previousOk || !latestOk {
+		return 0, false
+	}
+
+	_, isCounter64 := previousValue.(uint64)
+	if latest < previous && isCounter64 && previous > math.MaxUint64/2 {
+		// Unsigned subtraction wraps around exactly like the counter did
+		return latest - previous, true
+	} else if latest < previous {
+		return latest, true
+	}
+
+	return latest - previous, true
+}
+
+// Both are TimeTicks since boot, ifLastChange being 0 when the interface hasn't changed since then
+func formatTimeSinceResync(reading metricsReading) string {
+	upTimeOids := reading.fullOidsByOidPrefix[SysUpTime]
+	lastChangeOids := reading.fullOidsByOidPrefix[IfLastChange]
+	if len(upTimeOids) != 1 || len(lastChangeOids) != 1 {
+		return "?"
+	}
+
+	upTime, upTimeOk := toUint64(reading.valuesByQueryOids[upTimeOids[0]])
+	lastChange, lastChangeOk := toUint64(reading.valuesByQueryOids[lastChangeOids[0]])
+	if !upTimeOk || !lastChangeOk || lastChange > upTime {
+		return "?"
+	} else if lastChange == 0 {
+		return formatTimeTicks(upTime) + " (no resync since boot)"
+	}
+
+	return formatTimeTicks(upTime - lastChange)
+}
+
+// Share of the max rate not used by the current rate, direction being 0 for down and 1 for up
+func formatRateHeadroom(reading metricsReading, direction int) string {
+	currentOids := reading.fullOidsByOidPrefix[CurrentSyncRateBps]
+	maxOids := reading.fullOidsByOidPrefix[MaxSyncRateBps]
+	if len(currentOids) != 2 || len(maxOids) != 2 {
+		return "?"
+	}
+
+	currentRate, currentOk := toUint64(reading.valuesByQueryOids[currentOids[direction]])
+	maxRate, maxOk := toUint64(reading.valuesByQueryOids[maxOids[direction]])
+	if !currentOk || !maxOk || maxRate == 0 {
+		return "?"
+	}
+
+	return strconv.FormatFloat((float64(maxRate)-float64(currentRate))/float64(maxRate)*100, 'f', 1, 64)
+}
+
+// Average in bps over the interval between the two samples, direction being 0 for down and 1 for up
+func throughputBps(previous metricsReading, latest metricsReading, direction int) (uint64, bool) {
+	fullOids := latest.fullOidsByOidPrefix[IfHCInOctets]
+	elapsed := latest.time.Sub(previous.time)
+	if len(fullOids) != 2 || elapsed <= 0 {
+		return 0, false
+	}
+
+	delta, found := counterDelta(previous.valuesByQueryOids[fullOids[direction]], latest.valuesByQueryOids[fullOids[direction]])
+	if !found {
+		return 0, false
+	}
+
+	return uint64(float64(delta*8) / elapsed.Seconds()), true
+}
+
+func formatThroughput(previous metricsReading, latest metricsReading, direction int) string {
+	bps, found := throughputBps(previous, latest, direction)
+	if !found {
+		return "?"
+	}
+
+	return selectedRateUnit.format(bps)
+}
+
+// Share of the current sync rate used by the throughput, direction being 0 for down and 1 for up
+func formatUtilization(previous metricsReading, latest metricsReading, direction int) string {
+	bps, found := throughputBps(previous, latest, direction)
+	syncRateOids := latest.fullOidsByOidPrefix[CurrentSyncRateBps]
+	if !found || len(syncRateOids) != 2 {
+		return "?"
+	}
+
+	syncRate, castOk := toUint64(latest.valuesByQueryOids[syncRateOids[direction]])
+	if !castOk || syncRate == 0 {
+		return "?"
+	}
+
+	return strconv.FormatFloat(float64(bps)/float64(syncRate)*100, 'f', 0, 64)
+}
+
+func formatCounterDelta(item oidMetadata, fullOid string, previous metricsReading, latest metricsReading) string {
+	delta, found := counterDelta(previous.valuesByQueryOids[fullOid], latest.valuesByQueryOids[fullOid])
+	if !found {
+		return "?"
+	}
+
+	return item.valueFormatter(delta)
+}
+
+// Reads the given line every interval until ctx is done, independently of HTTP requests
+func (t *snmpTarget) poll(ctx context.Context, interval time.Duration, vdslIfIndex string, onReading func(metricsReading)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			onReading(t.readMetrics(ctx, vdslIfIndex))
+		}
+	}
+}
+
+func (t *snmpTarget) recordHistory(ctx context.Context, interval time.Duration) {
+	t.poll(ctx, interval, "", func(reading metricsReading) {
+		if reading.succeeded() {
+			t.history.add(reading)
+		}
+	})
+}
+
+// POSTs the same body as /json, independently of HTTP requests. Failures are only logged.
+func (t *snmpTarget) pushMetrics(ctx context.Context, pushUrl string, interval time.Duration) {
+	client := &http.Client{Timeout: pushTimeout}
+
+	t.poll(ctx, interval, "", func(reading metricsReading) {
+		body, err := json.Marshal(toJsonMetrics(t, reading))
+		if err != nil {
+			log.Printf("Failed to encode metrics of %s for push: %v", t.address, err)
+			return
+		}
+
+		err = postJson(ctx, client, pushUrl, body)
+		if err != nil {
+			log.Printf("Failed to push metrics of %s to %s: %v", t.address, pushUrl, err)
+		}
+	})
+}
+
+type alert struct {
+	Target    string      `json:"target"`
+	Metric    string      `json:"metric"`
+	Direction string      `json:"direction,omitempty"`
+	Value     interface{} `json:"value"`
+	Threshold *int64      `json:"threshold,omitempty"`
+	Time      time.Time   `json:"time"`
+}
+
+// POSTs an alert when a metric crosses its critical threshold or when the line resyncs. While the
+// condition lasts, the same alert is sent again at most once per debounce interval.
+func (t *snmpTarget) sendAlerts(ctx context.Context, webhookUrl string, interval time.Duration, debounce time.Duration) {
+	client := &http.Client{Timeout: pushTimeout}
+	lastSentTimes := make(map[string]time.Time)
+
+	send := func(alert alert) {
+		key := alert.Metric + "/" + alert.Direction
+		if time.Since(lastSentTimes[key]) < debounce {
+			return
+		}
+
+		body, err := json.Marshal(alert)
+		if err != nil {
+			log.Printf("Failed to encode alert of %s: %v", t.address, err)
+			return
+		}
+
+		err = postJson(ctx, client, webhookUrl, body)
+		if err != nil {
+			log.Printf("Failed to send alert of %s to %s: %v", t.address, webhookUrl, err)
+			return
+		}
+
+		lastSentTimes[key] = time.Now()
+	}
+
+	// ifLastChange of the previous sample, which moves forward when the line resyncs
+	var previousLastChange *uint64
+
+	t.poll(ctx, interval, "", func(reading metricsReading) {
+		if !reading.succeeded() {
+			return
+		}
+
+		for _, item := range oidMetadataList {
+			if item.thresholds == nil {
+				continue
+			}
+
+			fullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+			for i, fullOid := range fullOids {
+				rawValue := reading.valuesByQueryOids[fullOid]
+				if item.severity(rawValue) != "critical" {
+					continue
+				}
+
+				direction := ""
+				if len(fullOids) == 2 {
+					direction = directionNames[i]
+				}
+
+				send(alert{t.address, item.name(), direction, toJsonValue(rawValue), &item.thresholds.critical, reading.time})
+			}
+		}
+
+		lastChangeOids := reading.fullOidsByOidPrefix[IfLastChange]
+		if len(lastChangeOids) != 1 {
+			return
+		}
+
+		lastChange, castOk := toUint64(reading.valuesByQueryOids[lastChangeOids[0]])
+		if !castOk {
+			return
+		}
+
+		if previousLastChange != nil && lastChange != *previousLastChange {
+			send(alert{Target: t.address, Metric: "Line resync", Value: lastChange, Time: reading.time})
+		}
+
+		previousLastChange = &lastChange
+	})
+}
+
+const mqttPublishTimeout = 5 * time.Second
+
+// Publishes each metric to prefix/<metric>/<direction>, with the modem address added after the
+// prefix when there are several. The client reconnects on its own in the background, publications
+// are skipped while the broker is unreachable.
+func (s *Svc) publishMqtt(ctx context.Context, broker string, interval time.Duration) {
+	options := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(fmt.Sprintf("vigor-dsl-signal-stats-%d", os.Getpid())).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(minReconnectBackoff).
+		SetMaxReconnectInterval(maxReconnectBackoff).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT broker %s: %v", broker, err)
+		})
+
+	client := mqtt.NewClient(options)
+	client.Connect()
+	defer client.Disconnect(250)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !client.IsConnectionOpen() {
+				log.Printf("Not connected to MQTT broker %s, skipping publication", broker)
+				continue
+			}
+
+			for _, target := range s.targets {
+				topicPrefix := mqttTopicPrefix
+				if len(s.targets) > 1 {
+					topicPrefix += "/" + target.address
+				}
+
+				publishReading(client, topicPrefix, target.readMetrics(ctx, ""))
+			}
+		}
+	}
+}
+
+func publishReading(client mqtt.Client, topicPrefix string, reading metricsReading) {
+	if !reading.succeeded() {
+		return
+	}
+
+	publish := func(topic string, rawValue interface{}) {
+		value := plainValue(rawValue)
+		if value == "" {
+			return
+		}
+
+		token := client.Publish(topic, 0, true, value)
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			log.Printf("Timed out publishing %s to MQTT", topic)
+		} else if token.Error() != nil {
+			log.Printf("Failed to publish %s to MQTT: %v", topic, token.Error())
+		}
+	}
+
+	for _, item := range oidMetadataList {
+		topic := topicPrefix + "/" + metricSlug(item)
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 2 {
+			publish(topic+"/down", reading.valuesByQueryOids[expectedFullOids[0]])
+			publish(topic+"/up", reading.valuesByQueryOids[expectedFullOids[1]])
+		} else if len(expectedFullOids) == 1 {
+			publish(topic, reading.valuesByQueryOids[expectedFullOids[0]])
+		}
+	}
+}
+
+// Lines that couldn't be sent are kept for the next attempt, up to this many
+const maxGraphitePendingLines = 10000
+
+type graphiteSender struct {
+	address      string
+	conn         net.Conn
+	pendingLines []string
+}
+
+// Sends prefix.metric.direction lines, with the modem address added after the prefix when there
+// are several. Lines are kept and the connection reopened on the next interval when sending fails.
+func (s *Svc) sendGraphite(ctx context.Context, address string, interval time.Duration) {
+	sender := &graphiteSender{address: address}
+	defer sender.close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, target := range s.targets {
+				pathPrefix := graphitePrefix
+				if len(s.targets) > 1 {
+					pathPrefix += "." + strings.NewReplacer(".", "_", ":", "_").Replace(target.address)
+				}
+
+				sender.add(graphiteLines(pathPrefix, target.readMetrics(ctx, "")))
+			}
+
+			err := sender.flush()
+			if err != nil {
+				log.Printf("Failed to send metrics to Graphite %s, %d lines pending: %v", address, len(sender.pendingLines), err)
+			}
+		}
+	}
+}
+
+func graphiteLines(pathPrefix string, reading metricsReading) []string {
+	if !reading.succeeded() {
+		return nil
+	}
+
+	var lines []string
+	appendLine := func(path string, rawValue interface{}) {
+		if _, castOk := toUint64(rawValue); castOk {
+			lines = append(lines, fmt.Sprintf("%s %d %d\n", path, rawValue, reading.time.Unix()))
+		}
+	}
+
+	for _, item := range oidMetadataList {
+		path := pathPrefix + "." + metricSlug(item)
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 2 {
+			appendLine(path+".down", reading.valuesByQueryOids[expectedFullOids[0]])
+			appendLine(path+".up", reading.valuesByQueryOids[expectedFullOids[1]])
+		} else if len(expectedFullOids) == 1 {
+			appendLine(path, reading.valuesByQueryOids[expectedFullOids[0]])
+		}
+	}
+
+	return lines
+}
+
+func (g *graphiteSender) add(lines []string) {
+	g.pendingLines = append(g.pendingLines, lines...)
+	if len(g.pendingLines) > maxGraphitePendingLines {
+		g.pendingLines = g.pendingLines[len(g.pendingLines)-maxGraphitePendingLines:]
+	}
+}
+
+func (g *graphiteSender) flush() error {
+	if len(g.pendingLines) == 0 {
+		return nil
+	}
+
+	if g.conn == nil {
+		conn, err := net.DialTimeout("tcp", g.address, pushTimeout)
+		if err != nil {
+			return err
+		}
+
+		g.conn = conn
+	}
+
+	err := g.conn.SetWriteDeadline(time.Now().Add(pushTimeout))
+	if err == nil {
+		_, err = io.WriteString(g.conn, strings.Join(g.pendingLines, ""))
+	}
+
+	if err != nil {
+		g.close()
+		return err
+	}
+
+	g.pendingLines = g.pendingLines[:0]
+
+	return nil
+}
+
+func (g *graphiteSender) close() {
+	if g.conn != nil {
+		_ = g.conn.Close()
+		g.conn = nil
+	}
+}
+
+func postJson(ctx context.Context, client *http.Client, postUrl string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, postUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	return nil
+}
+
+type discoveryResult struct {
+	vdslIfIndex         string
+	xtucUpstreamSubId   string
+	xturDownstreamSubId string
+	// Per direction (0 down, 1 up), empty when the channel table couldn't be walked
+	latencyPaths [2][]latencyPath
+	// OID indexes of the line and first channel configuration profiles, empty when not exposed
+	lineProfileIndex    string
+	channelProfileIndex string
+}
+
+// Must be called with snmpLock held. Returns every DSL line of the modem, the default one first.
+func (t *snmpTarget) discover(ctx context.Context) ([]*discoveryResult, error) {
+	if t.discovery != nil {
+		return t.discovery, nil
+	}
+
+	vdslIfIndexes := []string{pinnedIfIndex}
+	if pinnedIfIndex == "" {
+		var err error
+		if ifDescrPattern != nil {
+			vdslIfIndexes, err = findIfIndexesByDescr(ctx, t.session, ifDescrPattern)
+		} else {
+			vdslIfIndexes, err = findVdslIfIndexes(ctx, t.session)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A line that isn't synced (e.g. the second line of a bonded modem) may not report its
+	// termination units, it is skipped until the next discovery instead of failing the others
+	var lines []*discoveryResult
+	var lineErrs []error
+	for _, vdslIfIndex := range vdslIfIndexes {
+		xtucUpstreamSubId, xturDownstreamSubId, err := findTerminationUnitIds(ctx, t.session, vdslIfIndex)
+		if err != nil {
+			log.Printf("Skipping DSL interface %s on %s: %v", vdslIfIndex, t.address, err)
+			lineErrs = append(lineErrs, err)
+			continue
+		}
+
+		// Only needed for the per-path stats, the line is read as a single path pair without them
+		latencyPaths, err := findLatencyPaths(t.session, vdslIfIndex, xtucUpstreamSubId, xturDownstreamSubId)
+		if err != nil {
+			log.Printf("Failed to find the latency paths of DSL interface %s on %s: %v", vdslIfIndex, t.address, err)
+		}
+
+		// Likewise only needed for the configured values, which are left out without them
+		lineProfileIndex, channelProfileIndex, err := findConfProfileIndexes(t.session, vdslIfIndex)
+		if err != nil {
+			log.Printf("Failed to find the configuration profiles of DSL interface %s on %s: %v", vdslIfIndex, t.address, err)
+		}
+
+		lines = append(lines, &discoveryResult{
+			vdslIfIndex:         vdslIfIndex,
+			xtucUpstreamSubId:   xtucUpstreamSubId,
+			xturDownstreamSubId: xturDownstreamSubId,
+			latencyPaths:        latencyPaths,
+			lineProfileIndex:    lineProfileIndex,
+			channelProfileIndex: channelProfileIndex,
+		})
+	}
+
+	if len(lines) == 0 {
+		return nil, errors.Join(lineErrs...)
+	}
+
+	t.discovery = lines
+
+	return t.discovery, nil
+}
+
+// Primes the discovery cache at startup so the first request doesn't pay for it
+func (t *snmpTarget) warmUp(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	if err := t.lock(ctx); err != nil {
+		log.Printf("Warmup discovery on %s skipped, will retry on the first request: %v", t.address, err)
+		return
+	}
+	defer t.unlock()
+	defer t.useContext(ctx)()
+
+	lines, err := t.discover(ctx)
+	if err != nil {
+		log.Printf("Warmup discovery failed on %s, will retry on the first request: %v", t.address, err)
+		return
+	}
+
+	log.Printf("Warmup discovered %d DSL interface(s) on %s", len(lines), t.address)
+}
+
+// Must be called with snmpLock held.
+func (t *snmpTarget) invalidateDiscovery() {
+	if t.discovery != nil {
+		log.Printf("Invalidating discovered interfaces on %s", t.address)
+	}
+
+	t.discovery = nil
+}
+
+type systemIdentity struct {
+	description string
+	name        string
+}
+
+// Returns nil if the modem couldn't be queried, in which case the next call tries again.
+func (t *snmpTarget) systemIdentity(ctx context.Context) *systemIdentity {
+	if t.lock(ctx) != nil {
+		return nil
+	}
+	defer t.unlock()
+	defer t.useContext(ctx)()
+
+	if t.identity != nil {
+		return t.identity
+	}
+
+	descrOid := string(SysDescr) + ".0"
+	nameOid := string(SysName) + ".0"
+	result, err := t.session.Get([]string{descrOid, nameOid})
+	if err != nil {
+		log.Printf("Failed to query system identity of %s: %v", t.address, err)
+		return nil
+	}
+
+	identity := &systemIdentity{}
+	for _, variable := range result.Variables {
+		octets, castOk := variable.Value.([]uint8)
+		if !castOk {
+			continue
+		}
+
+		switch variable.Name {
+		case descrOid:
+			identity.description = printableString(octets)
+		case nameOid:
+			identity.name = printableString(octets)
+		}
+	}
+
+	t.identity = identity
+
+	return t.identity
+}
+
+type metricsReading struct {
+	vdslIfIndex         string
+	allVdslIfIndexes    []string
+	ipAddress           string
+	fullOidsByOidPrefix map[oidPrefix][]string
+	latencyPaths        [2][]latencyPath
+	valuesByQueryOids   map[string]interface{}
+	typesByQueryOids    map[string]gosnmp.Asn1BER
+	time                time.Time
+	discoveryErr        error
+	err                 error
+}
+
+// Whether the number of latency paths is known, i.e. the channel table could be walked
+func (r metricsReading) hasLatencyPaths() bool {
+	return len(r.latencyPaths[0]) > 0 || len(r.latencyPaths[1]) > 0
+}
+
+func (r metricsReading) succeeded() bool {
+	return r.discoveryErr == nil && r.err == nil
+}
+
+// Failed reads are reported as errors so uptime monitors that only look at status codes notice them
+func (r metricsReading) httpStatus() int {
+	if errors.Is(r.discoveryErr, context.DeadlineExceeded) || errors.Is(r.err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	} else if r.discoveryErr != nil {
+		return http.StatusServiceUnavailable
+	} else if r.err != nil {
+		return http.StatusBadGateway
+	}
+
+	return http.StatusOK
+}
+
+// Must be called with snmpLock held. Queries of both clients are abandoned once ctx is done,
+// until the returned function is called.
+func (t *snmpTarget) useContext(ctx context.Context) func() {
+	restoreSession := t.session.useContext(ctx)
+	restoreAddressSession := t.addressSession.useContext(ctx)
+
+	return func() {
+		restoreSession()
+		restoreAddressSession()
+	}
+}
+
+// Bounds the SNMP queries made for one HTTP request by -request-timeout
+func requestContext(ctx *gserv.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx.Req.Context(), requestTimeout)
+}
+
+// Reads the line requested with ?ifindex=
+func readRequestedMetrics(ctx *gserv.Context, target *snmpTarget) metricsReading {
+	requestCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	return target.readMetrics(requestCtx, requestedIfIndex(ctx))
+}
+
+// An empty ifIndex reads the default line
+func (t *snmpTarget) readMetrics(ctx context.Context, vdslIfIndex string) metricsReading {
+	if err := t.lock(ctx); err != nil {
+		reading := newMetricsReading()
+		reading.err = fmt.Errorf("waiting for another read of %s: %w", t.address, err)
+		return reading
+	}
+	defer t.unlock()
+	defer t.useContext(ctx)()
+
+	reading := t.readMetricsOnce(ctx, vdslIfIndex)
+	if reading.succeeded() {
+		t.reconnectBackoff = minReconnectBackoff
+		t.recordReadStatus(reading)
+		return reading
+	}
+
+	t.invalidateDiscovery()
+
+	err := t.reconnectSnmp(ctx)
+	if err != nil {
+		log.Printf("Failed to reconnect via SNMP to %s: %v", t.address, err)
+	} else {
+		reading = t.readMetricsOnce(ctx, vdslIfIndex)
+	}
+
+	if reading.succeeded() {
+		t.reconnectBackoff = minReconnectBackoff
+		if len(t.communities) > 1 {
+			log.Printf("SNMP read from %s succeeded with community #%d", t.address, t.communityIndex+1)
+		}
+	} else {
+		t.reconnectBackoff = min(t.reconnectBackoff*2, maxReconnectBackoff)
+	}
+
+	t.recordReadStatus(reading)
+
+	return reading
+}
+
+type targetStatus struct {
+	Address              string                `json:"address"`
+	SnmpContextName      string                `json:"snmpContextName,omitempty"`
+	LastSuccessTime      time.Time             `json:"lastSuccessTime"`
+	LastError            string                `json:"lastError,omitempty"`
+	LastErrorTime        time.Time             `json:"lastErrorTime"`
+	ReconnectBackoff     string                `json:"reconnectBackoff"`
+	DiscoveredInterfaces []discoveredInterface `json:"discoveredInterfaces"`
+}
+
+type discoveredInterface struct {
+	IfIndex          string `json:"ifIndex"`
+	UpstreamUnitId   string `json:"upstreamUnitId"`
+	DownstreamUnitId string `json:"downstreamUnitId"`
+}
+
+// Must be called with snmpLock held.
+func (t *snmpTarget) recordReadStatus(reading metricsReading) {
+	t.lastReadSucceeded.Store(reading.succeeded())
+
+	t.statusMutex.Lock()
+	defer t.statusMutex.Unlock()
+
+	if reading.succeeded() {
+		t.status.LastSuccessTime = reading.time
+	} else {
+		t.status.LastError = errors.Join(reading.discoveryErr, reading.err).Error()
+		t.status.LastErrorTime = time.Now()
+	}
+
+	t.status.ReconnectBackoff = t.reconnectBackoff.String()
+
+	// Empty after a failed read invalidated the discovery
+	t.status.DiscoveredInterfaces = make([]discoveredInterface, 0, len(t.discovery))
+	for _, line := range t.discovery {
+		t.status.DiscoveredInterfaces = append(t.status.DiscoveredInterfaces, discoveredInterface{
+			IfIndex:          line.vdslIfIndex,
+			UpstreamUnitId:   line.xtucUpstreamSubId,
+			DownstreamUnitId: line.xturDownstreamSubId,
+		})
+	}
+}
+
+func newMetricsReading() metricsReading {
+	return metricsReading{
+		fullOidsByOidPrefix: make(map[oidPrefix][]string),
+		valuesByQueryOids:   make(map[string]interface{}),
+		typesByQueryOids:    make(map[string]gosnmp.Asn1BER),
+	}
+}
+
+func (t *snmpTarget) readMetricsOnce(ctx context.Context, requestedIfIndex string) metricsReading {
+	reading := newMetricsReading()
+
+	lines, err := t.discover(ctx)
+	if err != nil {
+		log.Printf("Discovery failed on %s: %v", t.address, err)
+		reading.discoveryErr = err
+		return reading
+	}
+
+	discovery := lines[0]
+	for _, line := range lines {
+		reading.allVdslIfIndexes = append(reading.allVdslIfIndexes, line.vdslIfIndex)
+		if line.vdslIfIndex == requestedIfIndex {
+			discovery = line
+		}
+	}
+
+	if requestedIfIndex != "" && discovery.vdslIfIndex != requestedIfIndex {
+		reading.discoveryErr = fmt.Errorf("no DSL interface with ifIndex %s", requestedIfIndex)
+		return reading
+	}
+
+	vdslIfIndex := discovery.vdslIfIndex
+	reading.vdslIfIndex = vdslIfIndex
+	xtucUpstreamSubId := discovery.xtucUpstreamSubId
+	xturDownstreamSubId := discovery.xturDownstreamSubId
+
+	var ipAddress string
+	var ipAddressWaitGroup sync.WaitGroup
+	ipAddressWaitGroup.Add(1)
+	go func() {
+		defer ipAddressWaitGroup.Done()
+		ipAddress = findVdslPppAdress(t.addressSession, vdslIfIndex)
+	}()
+
+	var queryOids []string
+
+	// Those of profiles the modem doesn't expose are left unset
+	placeholders := func(item oidMetadata) map[string]string {
+		values := map[string]string{
+			"Prefix":           string(item.oidPrefix),
+			"IfIndex":          vdslIfIndex,
+			"DownstreamUnitId": xturDownstreamSubId,
+			"UpstreamUnitId":   xtucUpstreamSubId,
+		}
+
+		if discovery.lineProfileIndex != "" {
+			values["LineProfileIndex"] = discovery.lineProfileIndex
+		}
+
+		if discovery.channelProfileIndex != "" {
+			values["ChannelProfileIndex"] = discovery.channelProfileIndex
+		}
+
+		return values
+	}
+
+	for _, item := range oidMetadataList {
+		var currentItemFullOids []string
+
+		for _, fullOidTemplate := range item.fullOidTemplates {
+			fullOid := expandOidTemplate(fullOidTemplate, placeholders(item))
+			if strings.Contains(fullOid, "{") {
+				// e.g. a profile the modem doesn't expose, the item is left out
+				currentItemFullOids = nil
+				break
+			}
+
+			reading.valuesByQueryOids[fullOid] = missingValue{}
+			currentItemFullOids = append(currentItemFullOids, fullOid)
+
+			// The direction not selected with -direction stays missing
+			if len(item.fullOidTemplates) == 2 && !slices.Contains(shownDirections, len(currentItemFullOids)-1) {
+				continue
+			}
+
+			queryOids = append(queryOids, fullOid)
+		}
+
+		reading.fullOidsByOidPrefix[item.oidPrefix] = currentItemFullOids
+	}
+
+	reading.latencyPaths = discovery.latencyPaths
+	for _, direction := range shownDirections {
+		if len(reading.latencyPaths[direction]) < 2 {
+			continue
+		}
+
+		for _, path := range reading.latencyPaths[direction] {
+			for _, prefix := range perPathOidPrefixes {
+				// The path under the line's own ifIndex is already queried for the line's metrics
+				fullOid := path.fullOid(prefix)
+				if _, found := reading.valuesByQueryOids[fullOid]; !found {
+					reading.valuesByQueryOids[fullOid] = missingValue{}
+					queryOids = append(queryOids, fullOid)
+				}
+			}
+		}
+	}
+
+	variables, err := getInChunks(t.session, queryOids, snmpMaxOidsPerRequest)
+	if err != nil {
+		log.Printf("Error fetching all OIDs from %s: %v", t.address, err)
+		reading.err = err
+	} else if isStaleDiscovery(variables) {
+		log.Printf("None of the OIDs exist on interface %s of %s anymore", vdslIfIndex, t.address)
+		reading.err = errors.New("interface no longer present")
+	} else {
+		reading.time = time.Now()
+		for _, v := range variables {
+			reading.valuesByQueryOids[v.Name] = v.Value
+			if isUnsupportedType(v.Type) {
+				reading.valuesByQueryOids[v.Name] = nil
+			}
+
+			reading.typesByQueryOids[v.Name] = v.Type
+		}
+
+		// Agents are supposed to answer every varbind, but some drop them instead of erroring
+		var missingOids []string
+		for _, queryOid := range queryOids {
+			if _, found := reading.typesByQueryOids[queryOid]; !found {
+				missingOids = append(missingOids, queryOid)
+			}
+		}
+
+		if len(missingOids) > 0 {
+			log.Printf("OIDs missing from the response of %s: %s", t.address, strings.Join(missingOids, ", "))
+		}
+	}
+
+	ipAddressWaitGroup.Wait()
+	reading.ipAddress = ipAddress
+
+	return reading
+}
+
+// Some agents silently truncate PDUs with too many varbinds, so big Gets are split up
+func getInChunks(client snmpGetter, oids []string, chunkSize int) ([]gosnmp.SnmpPDU, error) {
+	var variables []gosnmp.SnmpPDU
+	for chunkStart := 0; chunkStart < len(oids); chunkStart += chunkSize {
+		chunkVariables, err := getChunk(client, oids[chunkStart:min(chunkStart+chunkSize, len(oids))])
+		if err != nil {
+			return nil, err
+		}
+
+		variables = append(variables, chunkVariables...)
+	}
+
+	return variables, nil
+}
+
+// An error status fails the whole PDU, e.g. noSuchName on SNMPv1 for a single unsupported OID, so
+// the Get is issued again without the varbind at fault, which is reported as not supported.
+// A tooBig response is retried in halves instead.
+func getChunk(client snmpGetter, oids []string) ([]gosnmp.SnmpPDU, error) {
+	result, err := client.Get(oids)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Error == gosnmp.NoError {
+		return result.Variables, nil
+	}
+
+	if result.Error == gosnmp.TooBig && len(oids) > 1 {
+		firstHalf, err := getChunk(client, oids[:len(oids)/2])
+		if err != nil {
+			return nil, err
+		}
+
+		secondHalf, err := getChunk(client, oids[len(oids)/2:])
+		if err != nil {
+			return nil, err
+		}
+
+		return append(firstHalf, secondHalf...), nil
+	}
+
+	// ErrorIndex is 1-based, 0 when no varbind in particular is at fault
+	if result.ErrorIndex == 0 || int(result.ErrorIndex) > len(oids) {
+		return nil, fmt.Errorf("get failed with %v", result.Error)
+	}
+
+	failedIndex := int(result.ErrorIndex) - 1
+	log.Printf("Get of %s failed with %v, retrying the other OIDs without it", oids[failedIndex], result.Error)
+	failedVariable := gosnmp.SnmpPDU{Name: oids[failedIndex], Type: gosnmp.NoSuchObject}
+
+	remainingOids := slices.Delete(slices.Clone(oids), failedIndex, failedIndex+1)
+	if len(remainingOids) == 0 {
+		return []gosnmp.SnmpPDU{failedVariable}, nil
+	}
+
+	variables, err := getChunk(client, remainingOids)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(variables, failedVariable), nil
+}
+
+// A resync can move the line onto another ifIndex, in which case the agent
+// reports every OID under the previously discovered one as missing.
+func isStaleDiscovery(variables []gosnmp.SnmpPDU) bool {
+	for _, variable := range variables {
+		if variable.Type != gosnmp.NoSuchInstance && variable.Type != gosnmp.NoSuchObject {
+			return false
+		}
+	}
+
+	return len(variables) > 0
+}
+
+// The target is picked with the ?target= query parameter and defaults to the first one given to -ip.
+func (s *Svc) findTarget(ctx *gserv.Context) *snmpTarget {
+	requestedAddress := ctx.Req.URL.Query().Get("target")
+	if requestedAddress == "" {
+		return s.targets[0]
+	}
+
+	for _, target := range s.targets {
+		if target.address == requestedAddress {
+			return target
+		}
+	}
+
+	return nil
+}
+
+func (s *Svc) targetCacheKey(ctx *gserv.Context) string {
+	target := s.findTarget(ctx)
+	if target == nil {
+		return ""
+	}
+
+	address, port, _ := requestedAddress(ctx)
+
+	return target.address + "/" + address + ":" + port + "/" + requestedIfIndex(ctx) + "/" + requestedCommunity(ctx) + "/" +
+		negotiatedFormat(ctx) + "/" + ctx.Req.URL.Query().Get("format")
+}
+
+// The modem given to -ip picked with ?target=, or a throwaway one when ?ip=, ?port= or ?community=
+// override it, which release closes once the response is built. Every handler reading the modem
+// goes through this so the overrides apply whatever the route and output format.
+func (s *Svc) resolveTarget(ctx *gserv.Context) (target *snmpTarget, release func(), errorResponse gserv.Response) {
+	target = s.findTarget(ctx)
+	if target == nil {
+		return nil, nil, unknownTargetResponse()
+	}
+
+	overrideAddress, overridePort, err := requestedAddress(ctx)
+	if err != nil {
+		return nil, nil, gserv.CachedResponse(http.StatusBadRequest, "text/plain", err.Error())
+	}
+
+	overrideCommunity := requestedCommunity(ctx)
+	if overrideAddress == "" && overridePort == "" && overrideCommunity == "" {
+		return target, func() {}, nil
+	}
+
+	throwawayPort := snmpPort
+	if overridePort != "" {
+		throwawayPort, _ = strconv.Atoi(overridePort)
+	}
+
+	throwawayTarget, err := newThrowawaySnmpTarget(
+		cmp.Or(overrideAddress, target.address), throwawayPort, cmp.Or(overrideCommunity, communities[0]))
+	if err != nil {
+		return nil, nil, gserv.CachedResponse(http.StatusBadGateway, "text/plain", fmt.Sprintf("snmp connect failed: %v", err))
+	}
+
+	return throwawayTarget, throwawayTarget.close, nil
+}
+
+// Whether the request overrides the modem with a parameter allowed by -allow-target-override or -allow-community-override
+func hasTargetOverride(ctx *gserv.Context) bool {
+	address, port, _ := requestedAddress(ctx)
+	return address != "" || port != "" || requestedCommunity(ctx) != ""
+}
+
+// Modems with several DSL lines report the one picked with ?ifindex=, or the first discovered one
+func requestedIfIndex(ctx *gserv.Context) string {
+	return ctx.Req.URL.Query().Get("ifindex")
+}
+
+func unknownTargetResponse() gserv.Response {
+	return gserv.CachedResponse(http.StatusNotFound, "text/plain", "unknown target")
+}
+
+// Empty unless -allow-community-override or -allow-target-override is set
+func requestedCommunity(ctx *gserv.Context) string {
+	if !allowCommunityOverride && !allowTargetOverride {
+		return ""
+	}
+
+	return ctx.Req.URL.Query().Get("community")
+}
+
+// Returns the ?ip= and ?port= parameters as given, empty unless -allow-target-override is set
+func requestedAddress(ctx *gserv.Context) (address string, port string, err error) {
+	if !allowTargetOverride {
+		return "", "", nil
+	}
+
+	address = ctx.Req.URL.Query().Get("ip")
+	port = ctx.Req.URL.Query().Get("port")
+
+	if address != "" && net.ParseIP(address) == nil {
+		return address, port, fmt.Errorf("invalid ip %q", address)
+	}
+
+	if port != "" {
+		parsedPort, err := strconv.Atoi(port)
+		if err != nil || parsedPort <= 0 || parsedPort > 65535 {
+			return address, port, fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	return address, port, nil
+}
+
+const (
+	htmlFormat       = "html"
+	jsonFormat       = "json"
+	prometheusFormat = "prometheus"
+)
+
+// Picks the format given with ?format=, e.g. by scrapers that can't set headers, otherwise the first
+// media type of the Accept header that has an output format, HTML by default
+func negotiatedFormat(ctx *gserv.Context) string {
+	switch format := ctx.Req.URL.Query().Get("format"); format {
+	case htmlFormat, jsonFormat, prometheusFormat:
+		return format
+	}
+
+	for _, accepted := range strings.Split(ctx.Req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case mediaType == "text/html":
+			return htmlFormat
+		case mediaType == "application/json":
+			return jsonFormat
+		case mediaType == "text/plain" && params["version"] == "0.0.4":
+			return prometheusFormat
+		}
+	}
+
+	return htmlFormat
+}
+
+func (s *Svc) HandleRequest(ctx *gserv.Context) gserv.Response {
+	switch negotiatedFormat(ctx) {
+	case jsonFormat:
+		return s.HandleJsonRequest(ctx)
+	case prometheusFormat:
+		return s.HandlePrometheusRequest(ctx)
+	}
+
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	page, status := buildPage(ctx, target)
+	page.Css = template.CSS(pageCss)
+	if pageMode == "ajax" {
+		page.PollSeconds = refreshSeconds
+	} else {
+		page.RefreshSeconds = refreshSeconds
+	}
+
+	return renderPage(status, page)
+}
+
+// The entries of the page, also returned by /json?format=page for -mode ajax to update them in place
+func buildPage(ctx *gserv.Context, target *snmpTarget) (page pageData, status int) {
+	requestCtx, cancel := requestContext(ctx)
+	defer cancel()
+
+	if identity := target.systemIdentity(requestCtx); identity != nil {
+		page.SystemName = identity.name
+		page.SystemDescription = identity.description
+	}
+
+	// Helper to add entries with a single plain value
+	addEntry := func(name, value string) {
+		page.Entries = append(page.Entries, pageEntry{Name: name, Values: []pageValue{{Text: strings.TrimSpace(value)}}})
+	}
+
+	addEntry("Modem", target.address)
+
+	reading := target.readMetrics(requestCtx, requestedIfIndex(ctx))
+	if errors.Is(reading.discoveryErr, errNoDslInterface) {
+		addEntry("Status", "Line not synced, no DSL interface found (will retry on next refresh)")
+		return page, reading.httpStatus()
+	} else if reading.discoveryErr != nil {
+		addEntry("Status", fmt.Sprintf("Discovery failed, will retry on next refresh (%v)", reading.discoveryErr))
+		return page, reading.httpStatus()
+	}
+
+	addEntry("Interface", reading.vdslIfIndex)
+
+	if len(reading.allVdslIfIndexes) > 1 {
+		linksEntry := pageEntry{Name: "DSL interfaces"}
+		for _, vdslIfIndex := range reading.allVdslIfIndexes {
+			// Keeps the other parameters such as ?target= or ?ip=
+			query := ctx.Req.URL.Query()
+			query.Set("ifindex", vdslIfIndex)
+			linksEntry.Links = append(linksEntry.Links, pageLink{Href: "?" + query.Encode(), Text: vdslIfIndex})
+		}
+
+		page.Entries = append(page.Entries, linksEntry)
+	}
+
+	addEntry("PPP IP Address", reading.ipAddress)
+
+	if reading.err != nil {
+		addEntry("Status", fmt.Sprintf("SNMP Error (%v)", reading.err))
+	} else {
+		// Time of the SNMP read rather than of the request, as the page may come from the cache
+		addEntry("Last read", reading.time.Format(time.TimeOnly))
+	}
+
+	previousSample, latestSample, hasDeltas := target.history.lastTwo()
+	hasDeltas = hasDeltas && latestSample.vdslIfIndex == reading.vdslIfIndex
+
+	// Carries the CSS class of the threshold the value crosses, if any
+	formatValue := func(item oidMetadata, fullOid string) pageValue {
+		rawValue := reading.valuesByQueryOids[fullOid]
+		return pageValue{Text: item.valueFormatter(rawValue), Class: item.severity(rawValue)}
+	}
+
+	// Directional entries only get the values of the directions selected with -direction
+	directionalEntry := func(name string, suffix string, formatDirection func(direction int) pageValue) pageEntry {
+		entry := pageEntry{Name: name, Suffix: suffix}
+		if len(shownDirections) == 1 {
+			entry.Name = strings.Replace(name, "(down/up)", "("+directionNames[shownDirections[0]]+")", 1)
+		}
+
+		for _, direction := range shownDirections {
+			entry.Values = append(entry.Values, formatDirection(direction))
+		}
+
+		return entry
+	}
+
+	// Shown even without a vendor OID for it, so a non-vectored line can be told from one not looked at
+	vectoringIndex := slices.IndexFunc(oidMetadataList, func(item oidMetadata) bool {
+		return item.isVectoringState
+	})
+	if vectoringIndex < 0 || reading.isAbsent(oidMetadataList[vectoringIndex]) {
+		addEntry("Vectoring", "not reported")
+	} else if item := oidMetadataList[vectoringIndex]; len(reading.fullOidsByOidPrefix[item.oidPrefix]) == 2 {
+		page.Entries = append(page.Entries, directionalEntry("Vectoring (down/up)", "", func(direction int) pageValue {
+			return formatValue(item, reading.fullOidsByOidPrefix[item.oidPrefix][direction])
+		}))
+	} else {
+		addEntry("Vectoring", item.valueFormatter(reading.valuesByQueryOids[reading.fullOidsByOidPrefix[item.oidPrefix][0]]))
+	}
+
+	for _, item := range oidMetadataList {
+		if limitItem, found := findLimitOf(item.oidPrefix); found && len(reading.fullOidsByOidPrefix[limitItem.oidPrefix]) == 2 && !reading.isAbsent(limitItem) {
+			page.Entries = append(page.Entries, directionalEntry(item.description, "", func(direction int) pageValue {
+				return pageValue{Text: describeActualVsLimit(reading, item, limitItem, direction)}
+			}))
+			continue
+		}
+
+		if item.oidPrefix == InterleaveDepth {
+			page.Entries = append(page.Entries, directionalEntry("Path (down/up)", "", func(direction int) pageValue {
+				return pageValue{Text: describeLatencyPath(reading, direction)}
+			}))
+
+			if reading.hasLatencyPaths() {
+				page.Entries = append(page.Entries, directionalEntry("Latency paths (down/up)", "", func(direction int) pageValue {
+					return pageValue{Text: strconv.Itoa(len(reading.latencyPaths[direction]))}
+				}))
+			}
+
+			for _, direction := range shownDirections {
+				if len(reading.latencyPaths[direction]) < 2 {
+					continue
+				}
+
+				for _, path := range reading.latencyPaths[direction] {
+					addEntry(
+						fmt.Sprintf("Latency path %d (%s)", path.number, directionNames[direction]),
+						describeLatencyPathStats(reading, path))
+				}
+			}
+			continue
+		} else if slices.Contains(latencyPathOidPrefixes, item.oidPrefix) || item.limitOf != "" || item.isVectoringState {
+			continue
+		}
+
+		entry := pageEntry{Name: item.description, Suffix: item.unit}
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 0 || (item.omitWhenAbsent && reading.isAbsent(item)) {
+			// Not expanded for this line, or not returned by the modem
+			continue
+		} else if len(expectedFullOids) == 2 {
+			entry = directionalEntry(item.description, item.unit, func(direction int) pageValue {
+				return formatValue(item, expectedFullOids[direction])
+			})
+
+			if item.isCounter && hasDeltas {
+				var deltas []string
+				for _, direction := range shownDirections {
+					deltas = append(deltas, "+"+formatCounterDelta(item, expectedFullOids[direction], previousSample, latestSample))
+				}
+
+				entry.Suffix += fmt.Sprintf(" (%s last interval)", strings.Join(deltas, " / "))
+			}
+		} else if len(expectedFullOids) == 1 {
+			entry.Values = []pageValue{formatValue(item, expectedFullOids[0])}
+
+			if item.isCounter && hasDeltas {
+				entry.Suffix += fmt.Sprintf(
+					" (+%s last interval)",
+					formatCounterDelta(item, expectedFullOids[0], previousSample, latestSample))
+			}
+		} else {
+			entry.Values = []pageValue{{Text: "(error: unexpected oid count)"}}
+			entry.Suffix = ""
+		}
+
+		entry.Suffix = strings.TrimSpace(entry.Suffix)
+		page.Entries = append(page.Entries, entry)
+	}
+
+	if reading.err == nil {
+		addEntry("Time since resync", formatTimeSinceResync(reading))
+		page.Entries = append(page.Entries, directionalEntry("Rate headroom (down/up)", "%", func(direction int) pageValue {
+			return pageValue{Text: formatRateHeadroom(reading, direction)}
+		}))
+	}
+
+	if hasDeltas {
+		page.Entries = append(page.Entries, directionalEntry("Throughput (down/up)", selectedRateUnit.label, func(direction int) pageValue {
+			return pageValue{Text: formatThroughput(previousSample, latestSample, direction)}
+		}))
+		page.Entries = append(page.Entries, directionalEntry("Link utilization (down/up)", "%", func(direction int) pageValue {
+			return pageValue{Text: formatUtilization(previousSample, latestSample, direction)}
+		}))
+	}
+
+	if reading.err == nil {
+		// Downstream table first, then upstream
+		for direction, table := range bandSnrMarginTables(target.readBandSnrMargins(requestCtx, reading.vdslIfIndex)) {
+			if slices.Contains(shownDirections, direction) {
+				page.BandTables = append(page.BandTables, table)
+			}
+		}
+	}
+
+	return page, reading.httpStatus()
+}
+
+//go:embed page.html
+var pageTemplateSource string
+
+//go:embed page.css
+var pageCss string
+
+// Parsed once at startup, html/template escapes every value inserted in the page
+var pageTemplate = template.Must(template.New("page").Parse(pageTemplateSource))
+
+type pageData struct {
+	RefreshSeconds    int
+	PollSeconds       int
+	Css               template.CSS
+	SystemName        string
+	SystemDescription string
+	Entries           []pageEntry
+	BandTables        []bandSnrMarginTable
+}
+
+// Values are separated by " / ", directional metrics having the downstream value first
+type pageEntry struct {
+	Name   string      `json:"name"`
+	Values []pageValue `json:"values"`
+	Suffix string      `json:"suffix,omitempty"`
+	Links  []pageLink  `json:"links,omitempty"`
+}
+
+type pageValue struct {
+	Text  string `json:"text"`
+	Class string `json:"class,omitempty"`
+}
+
+type pageLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+// Returned by /json?format=page, the values formatted as on the page
+type pageJson struct {
+	Entries    []pageEntry          `json:"entries"`
+	BandTables []bandSnrMarginTable `json:"bandTables"`
+}
+
+func renderPage(status int, page pageData) gserv.Response {
+	var body bytes.Buffer
+	err := pageTemplate.Execute(&body, page)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to render page: %v", err))
+	}
+
+	return gserv.CachedResponse(status, "text/html; charset=utf-8", body.String())
+}
+
+// Values of xdsl2LineBand, the aggregate upstream(1) and downstream(2) are followed by
+// us0(3), ds1(4), us1(5), ds2(6), ... so odd bands are upstream and even ones downstream.
+const firstUpstreamBand = 3
+const firstDownstreamBand = 4
+
+// xdsl2LineBandStatusSnrMargin special values
+const bandSnrMarginNotFeasible = 2147483646
+const bandSnrMarginNotAvailable = 2147483647
+
+type bandSnrMargin struct {
+	band        int
+	tenthsOfDb  int64
+	isAvailable bool
+}
+
+// Returns nil if the modem doesn't expose xdsl2LineBandTable
+func (t *snmpTarget) readBandSnrMargins(ctx context.Context, vdslIfIndex string) []bandSnrMargin {
+	if t.lock(ctx) != nil {
+		return nil
+	}
+	defer t.unlock()
+	defer t.useContext(ctx)()
+
+	valuesBySuffix, err := walkUnderIfIndex(t.session, BandSnrMargin, vdslIfIndex)
+	if err != nil {
+		log.Printf("Failed to walk band SNR margins on %s: %v", t.address, err)
+		return nil
+	}
+
+	var margins []bandSnrMargin
+	for suffix, rawValue := range valuesBySuffix {
+		band, err := strconv.Atoi(suffix)
+		if err != nil || band < firstUpstreamBand {
+			continue
+		}
+
+		tenthsOfDb, castOk := toInt64(rawValue)
+		if !castOk {
+			continue
+		}
+
+		margins = append(margins, bandSnrMargin{
+			band:        band,
+			tenthsOfDb:  tenthsOfDb,
+			isAvailable: tenthsOfDb != bandSnrMarginNotFeasible && tenthsOfDb != bandSnrMarginNotAvailable,
+		})
+	}
+
+	slices.SortFunc(margins, func(a, b bandSnrMargin) int {
+		return a.band - b.band
+	})
+
+	return margins
+}
+
+// Walks the table column under prefix for one interface, keyed by the rest of the index after the ifIndex
+func walkUnderIfIndex(client snmpWalker, prefix oidPrefix, vdslIfIndex string) (map[string]interface{}, error) {
+	subtree := string(prefix) + "." + vdslIfIndex
+	results, err := walkAll(client, subtree)
+	if err != nil {
+		return nil, err
+	}
+
+	valuesBySuffix := make(map[string]interface{})
+	for _, result := range results {
+		suffix, found := strings.CutPrefix(
+			strings.TrimPrefix(result.Name, "."), strings.TrimPrefix(subtree, ".")+".")
+		if found && result.Value != nil {
+			valuesBySuffix[suffix] = result.Value
+		}
+	}
+
+	return valuesBySuffix, nil
+}
+
+type bandSnrMarginTable struct {
+	Title string             `json:"title"`
+	Rows  []bandSnrMarginRow `json:"rows"`
+}
+
+type bandSnrMarginRow struct {
+	Band  string `json:"band"`
+	Value string `json:"value"`
+}
+
+func bandSnrMarginTables(margins []bandSnrMargin) []bandSnrMarginTable {
+	if len(margins) == 0 {
+		return nil
+	}
+
+	var tables []bandSnrMarginTable
+	for _, direction := range []struct {
+		title     string
+		bandLabel string
+		firstBand int
+	}{
+		{"Downstream SNR margin per band", "DS", firstDownstreamBand},
+		{"Upstream SNR margin per band", "US", firstUpstreamBand},
+	} {
+		table := bandSnrMarginTable{Title: direction.title}
+		for _, margin := range margins {
+			if margin.band%2 != direction.firstBand%2 {
+				continue
+			}
+
+			value := "n/a"
+			if margin.isAvailable {
+				value = fmt.Sprintf("%.1f dB", float64(margin.tenthsOfDb)/10)
+			}
+
+			// us0 is numbered from 0 while ds1 is numbered from 1, matching G.993.2
+			bandNumber := (margin.band - firstUpstreamBand) / 2
+			if direction.firstBand == firstDownstreamBand {
+				bandNumber = (margin.band-firstDownstreamBand)/2 + 1
+			}
+
+			table.Rows = append(table.Rows, bandSnrMarginRow{Band: fmt.Sprintf("%s%d", direction.bandLabel, bandNumber), Value: value})
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables
+}
+
+//go:embed favicon.png
+var faviconPng []byte
+
+// Served without auth or SNMP so the browser's automatic requests stay cheap on every refresh
+func HandleFaviconRequest(ctx *gserv.Context) gserv.Response {
+	ctx.Header().Set("Cache-Control", "public, max-age=86400")
+	return gserv.PlainResponse("image/png", faviconPng)
+}
+
+// Directional metrics have the downstream value first
+var directionNames = []string{"down", "up"}
+
+// Shown together as one "Path" entry in the HTML page instead of one entry each. These are the values
+// of the line's first path, lines with several paths also get an entry per path.
+var latencyPathOidPrefixes = []oidPrefix{InterleaveDepth, InterleaveDelayMs, ChannelStatusLPath}
+
+func findOidMetadata(prefix oidPrefix) oidMetadata {
+	index := slices.IndexFunc(oidMetadataList, func(item oidMetadata) bool {
+		return item.oidPrefix == prefix
+	})
+
+	return oidMetadataList[index]
+}
+
+// e.g. "interleaved, depth 8, delay 4 ms, latency path 0", direction being 0 for down and 1 for up
+func describeLatencyPath(reading metricsReading, direction int) string {
+	formatDirection := func(prefix oidPrefix) string {
+		fullOids := reading.fullOidsByOidPrefix[prefix]
+		if len(fullOids) != 2 {
+			return "(error: unexpected oid count)"
+		}
+
+		item := findOidMetadata(prefix)
+		return strings.TrimSpace(item.valueFormatter(reading.valuesByQueryOids[fullOids[direction]]) + " " + item.unit)
+	}
+
+	latencyPath := "latency path " + formatDirection(ChannelStatusLPath)
+
+	depth, castOk := toUint64(reading.valuesByQueryOids[reading.fullOidsByOidPrefix[InterleaveDepth][direction]])
+	if !castOk {
+		return formatDirection(InterleaveDepth) + ", " + latencyPath
+	} else if depth == 1 {
+		return "fast, " + latencyPath
+	}
+
+	return fmt.Sprintf("interleaved, depth %d, delay %s, %s", depth, formatDirection(InterleaveDelayMs), latencyPath)
+}
+
+// The configured limit of the actual value under prefix, if any
+func findLimitOf(prefix oidPrefix) (oidMetadata, bool) {
+	index := slices.IndexFunc(oidMetadataList, func(item oidMetadata) bool {
+		return item.limitOf == prefix
+	})
+	if index < 0 {
+		return oidMetadata{}, false
+	}
+
+	return oidMetadataList[index], true
+}
+
+// e.g. "actual 20 units, target 2 symbols"
+func describeActualVsLimit(reading metricsReading, actualItem oidMetadata, limitItem oidMetadata, direction int) string {
+	formatItem := func(item oidMetadata) string {
+		fullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(fullOids) != 2 {
+			return "(error: unexpected oid count)"
+		}
+
+		return strings.TrimSpace(item.valueFormatter(reading.valuesByQueryOids[fullOids[direction]]) + " " + item.unit)
+	}
+
+	return fmt.Sprintf("actual %s, target %s", formatItem(actualItem), formatItem(limitItem))
+}
+
+// e.g. "80.00 Mbps, INP 2 units, delay 0.8 ms"
+func describeLatencyPathStats(reading metricsReading, path latencyPath) string {
+	formatPrefix := func(prefix oidPrefix) string {
+		item := findOidMetadata(prefix)
+		return strings.TrimSpace(item.valueFormatter(reading.valuesByQueryOids[path.fullOid(prefix)]) + " " + item.unit)
+	}
+
+	return fmt.Sprintf("%s, INP %s, delay %s",
+		formatPrefix(CurrentSyncRateBps), formatPrefix(ActualImpulseProtection), formatPrefix(InterleaveDelayMs))
+}
+
+// Values of all directions followed by the unit, e.g. "100.00 / 40.00 Mbps"
+func formatOidValues(reading metricsReading, prefix oidPrefix) string {
+	item := findOidMetadata(prefix)
+
+	var values []string
+	for _, fullOid := range shownFullOids(reading, item) {
+		values = append(values, item.valueFormatter(reading.valuesByQueryOids[fullOid]))
+	}
+
+	return strings.TrimSpace(strings.Join(values, " / ") + " " + item.unit)
+}
+
+// Whether none of the values of item shown with -direction were returned by the modem
+func (r metricsReading) isAbsent(item oidMetadata) bool {
+	return !slices.ContainsFunc(shownFullOids(r, item), func(fullOid string) bool {
+		_, isAbsent := describeAbsentValue(r.valuesByQueryOids[fullOid])
+		return !isAbsent
+	})
+}
+
+// The full OIDs of item without the direction not selected with -direction, which isn't queried
+func shownFullOids(reading metricsReading, item oidMetadata) []string {
+	fullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+	if len(fullOids) != 2 {
+		return fullOids
+	}
+
+	var shown []string
+	for _, direction := range shownDirections {
+		shown = append(shown, fullOids[direction])
+	}
+
+	return shown
+}
+
+//go:embed compact.html
+var compactPageTemplateSource string
+
+var compactPageTemplate = template.Must(template.New("compact").Parse(compactPageTemplateSource))
+
+type compactPageData struct {
+	RefreshSeconds int
+	Text           string
+}
+
+// Single line for embedding in other dashboards, e.g. "Sync: 100.00 / 40.00 Mbps | SNR: 6 / 6 dB | Up: 3d 4h 5m 6s"
+func (s *Svc) HandleCompactRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	reading := readRequestedMetrics(ctx, target)
+
+	page := compactPageData{RefreshSeconds: refreshSeconds}
+	if errors.Is(reading.discoveryErr, errNoDslInterface) {
+		page.Text = "Line not synced"
+	} else if reading.discoveryErr != nil {
+		page.Text = fmt.Sprintf("Discovery failed (%v)", reading.discoveryErr)
+	} else if reading.err != nil {
+		page.Text = fmt.Sprintf("SNMP Error (%v)", reading.err)
+	} else {
+		page.Text = strings.Join([]string{
+			"Sync: " + formatOidValues(reading, CurrentSyncRateBps),
+			"SNR: " + formatOidValues(reading, SnrMarginDb),
+			"Up: " + formatOidValues(reading, SysUpTime),
+		}, " | ")
+	}
+
+	var body bytes.Buffer
+	err := compactPageTemplate.Execute(&body, page)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to render page: %v", err))
+	}
+
+	return gserv.CachedResponse(reading.httpStatus(), "text/html; charset=utf-8", body.String())
+}
+
+func (s *Svc) HandleDebugRequest(*gserv.Context) gserv.Response {
+	statuses := make([]targetStatus, 0, len(s.targets))
+	for _, target := range s.targets {
+		target.statusMutex.Lock()
+		status := target.status
+		target.statusMutex.Unlock()
+
+		status.Address = target.address
+		status.SnmpContextName = snmpV3ContextName
+		statuses = append(statuses, status)
+	}
+
+	body, err := json.Marshal(statuses)
+	if err != nil {
+		panic("Failed to encode json")
+	}
+
+	return gserv.PlainResponse("application/json", string(body))
+}
+
+func (s *Svc) HandleHealthRequest(*gserv.Context) gserv.Response {
+	for _, target := range s.targets {
+		if !target.lastReadSucceeded.Load() {
+			return gserv.CachedResponse(http.StatusServiceUnavailable, "text/plain", "snmp unavailable: "+target.address)
+		}
+	}
+
+	return gserv.PlainResponse("text/plain", "ok")
+}
+
+// Debugging aid listing every queried OID with the template it was expanded from and the raw gosnmp value
+func (s *Svc) HandleRawRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	reading := readRequestedMetrics(ctx, target)
+
+	page := rawPageData{Css: template.CSS(pageCss)}
+	if reading.discoveryErr != nil {
+		page.Error = fmt.Sprintf("Discovery failed: %v", reading.discoveryErr)
+	} else if reading.err != nil {
+		page.Error = fmt.Sprintf("SNMP Error: %v", reading.err)
+	}
+
+	for _, item := range oidMetadataList {
+		for i, fullOid := range reading.fullOidsByOidPrefix[item.oidPrefix] {
+			typeName := "(not returned)"
+			value := ""
+			if asnType, found := reading.typesByQueryOids[fullOid]; found {
+				typeName = asnType.String()
+				value = fmt.Sprintf("%v", reading.valuesByQueryOids[fullOid])
+			}
+
+			page.Rows = append(page.Rows, rawOidRow{
+				Metric:   item.description,
+				Template: item.fullOidTemplates[i],
+				Oid:      fullOid,
+				Type:     typeName,
+				Value:    value,
+			})
+		}
+	}
+
+	var body bytes.Buffer
+	err := rawPageTemplate.Execute(&body, page)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to render page: %v", err))
+	}
+
+	return gserv.PlainResponse("text/html; charset=utf-8", body.String())
+}
+
+//go:embed raw.html
+var rawPageTemplateSource string
+
+var rawPageTemplate = template.Must(template.New("raw").Parse(rawPageTemplateSource))
+
+type rawPageData struct {
+	Css   template.CSS
+	Error string
+	Rows  []rawOidRow
+}
+
+type rawOidRow struct {
+	Metric   string
+	Template string
+	Oid      string
+	Type     string
+	Value    string
+}
+
+type directionalValue struct {
+	Downstream interface{} `json:"downstream"`
+	Upstream   interface{} `json:"upstream"`
+}
+
+// The rate, INP and delay are only read for directions with several paths, and are null otherwise
+type latencyPathJson struct {
+	Path              uint64      `json:"path"`
+	Rate              interface{} `json:"rate"`
+	ImpulseProtection interface{} `json:"impulseProtection"`
+	Delay             interface{} `json:"delay"`
+}
+
+func latencyPathsJson(reading metricsReading, direction int) []latencyPathJson {
+	var paths []latencyPathJson
+	for _, path := range reading.latencyPaths[direction] {
+		paths = append(paths, latencyPathJson{
+			Path:              path.number,
+			Rate:              reading.jsonValue(path.fullOid(CurrentSyncRateBps)),
+			ImpulseProtection: reading.jsonValue(path.fullOid(ActualImpulseProtection)),
+			Delay:             reading.jsonValue(path.fullOid(InterleaveDelayMs)),
+		})
+	}
+
+	return paths
+}
+
+func (s *Svc) HandleJsonRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	if ctx.Req.URL.Query().Get("format") == "page" {
+		page, status := buildPage(ctx, target)
+		body, err := json.Marshal(pageJson{page.Entries, page.BandTables})
+		if err != nil {
+			panic("Failed to encode json")
+		}
+
+		return gserv.CachedResponse(status, "application/json", string(body))
+	}
+
+	reading := readRequestedMetrics(ctx, target)
+	body, err := json.Marshal(toJsonMetrics(target, reading))
+	if err != nil {
+		panic("Failed to encode json")
+	}
+
+	return gserv.CachedResponse(reading.httpStatus(), "application/json", string(body))
+}
+
+func toJsonMetrics(target *snmpTarget, reading metricsReading) map[string]interface{} {
+	output := make(map[string]interface{})
+	output["Modem"] = target.address
+	if reading.discoveryErr != nil {
+		output["Status"] = fmt.Sprintf("Discovery failed (%v)", reading.discoveryErr)
+	} else {
+		output["Interface"] = reading.vdslIfIndex
+		output["PPP IP Address"] = reading.ipAddress
+	}
+
+	if reading.err != nil {
+		output["Status"] = "SNMP Error"
+	}
+
+	for _, item := range oidMetadataList {
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 2 {
+			output[item.description] = directionalValue{
+				Downstream: reading.jsonValue(expectedFullOids[0]),
+				Upstream:   reading.jsonValue(expectedFullOids[1]),
+			}
+		} else if len(expectedFullOids) == 1 {
+			output[item.description] = reading.jsonValue(expectedFullOids[0])
+		}
+	}
+
+	if reading.hasLatencyPaths() {
+		output["Latency paths"] = directionalValue{
+			Downstream: latencyPathsJson(reading, 0),
+			Upstream:   latencyPathsJson(reading, 1),
+		}
+	}
+
+	return output
+}
+
+// One row per value, e.g. for Grafana tables
+type tableJsonRow struct {
+	Metric    string      `json:"metric"`
+	Direction string      `json:"direction,omitempty"`
+	Value     interface{} `json:"value"`
+	Unit      string      `json:"unit,omitempty"`
+}
+
+func (s *Svc) HandleTableJsonRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	reading := readRequestedMetrics(ctx, target)
+
+	rows := make([]tableJsonRow, 0, len(oidMetadataList))
+	for _, item := range oidMetadataList {
+		// Values are raw, unlike rates displayed in the -rate-unit
+		unit := item.unit
+		if item.isRate {
+			unit = bpsRate.label
+		}
+
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 2 {
+			rows = append(rows,
+				tableJsonRow{item.name(), "down", reading.jsonValue(expectedFullOids[0]), unit},
+				tableJsonRow{item.name(), "up", reading.jsonValue(expectedFullOids[1]), unit})
+		} else if len(expectedFullOids) == 1 {
+			rows = append(rows, tableJsonRow{item.name(), "", reading.jsonValue(expectedFullOids[0]), unit})
+		}
+	}
+
+	body, err := json.Marshal(rows)
+	if err != nil {
+		panic("Failed to encode json")
+	}
+
+	return gserv.CachedResponse(reading.httpStatus(), "application/json", string(body))
+}
+
+type metricMeta struct {
+	Description string `json:"description"`
+	Unit        string `json:"unit,omitempty"`
+	Directional bool   `json:"directional"`
+	Counter     bool   `json:"counter"`
+	OidPrefix   string `json:"oidPrefix"`
+}
+
+// Definitions of the reported metrics, -oids ones included, for frontends to render labels and units
+func HandleMetricsMetaRequest(*gserv.Context) gserv.Response {
+	metrics := make([]metricMeta, 0, len(oidMetadataList))
+	for _, item := range oidMetadataList {
+		metrics = append(metrics, metricMeta{
+			Description: item.description,
+			Unit:        item.unit,
+			Directional: len(item.fullOidTemplates) == 2,
+			Counter:     item.isCounter,
+			OidPrefix:   string(item.oidPrefix),
+		})
+	}
+
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		panic("Failed to encode json")
+	}
+
+	return gserv.PlainResponse("application/json", string(body))
+}
+
+type historyJsonSample struct {
+	Time    time.Time              `json:"time"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+// Writes one history-style JSON sample per line every -refresh seconds until the client disconnects
+func (s *Svc) HandleStreamRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	vdslIfIndex := requestedIfIndex(ctx)
+	responseController := http.NewResponseController(ctx.ResponseWriter)
+	encoder := json.NewEncoder(ctx)
+
+	ctx.Header().Set("Content-Type", "application/x-ndjson")
+	ctx.WriteHeader(http.StatusOK)
+
+	// The request context is cancelled when the client disconnects, which stops the polling
+	requestCtx, cancel := context.WithCancel(ctx.Req.Context())
+	defer cancel()
+
+	writeSample := func(reading metricsReading) {
+		err := encoder.Encode(historyJsonSample{reading.time, toJsonMetrics(target, reading)})
+		if err == nil {
+			err = responseController.Flush()
+		}
+
+		if err != nil {
+			cancel()
+		}
+	}
+
+	writeSample(target.readMetrics(requestCtx, vdslIfIndex))
+	target.poll(requestCtx, time.Duration(max(refreshSeconds, 1))*time.Second, vdslIfIndex, writeSample)
+
+	// Everything has been written already
+	return nil
+}
+
+func (s *Svc) HandleHistoryRequest(ctx *gserv.Context) gserv.Response {
+	// Throwaway targets keep no history
+	if hasTargetOverride(ctx) {
+		return gserv.CachedResponse(http.StatusBadRequest, "text/plain", "?ip=, ?port= and ?community= aren't supported by /history.json")
+	}
+
+	target := s.findTarget(ctx)
+	if target == nil {
+		return unknownTargetResponse()
+	}
+
+	samples := make([]historyJsonSample, 0)
+	for _, reading := range target.history.snapshot() {
+		samples = append(samples, historyJsonSample{reading.time, toJsonMetrics(target, reading)})
+	}
+
+	body, err := json.Marshal(samples)
+	if err != nil {
+		panic("Failed to encode json")
+	}
+
+	return gserv.PlainResponse("application/json", string(body))
+}
+
+// OIDs missing from the Get result are null rather than a placeholder, so consumers can tell
+// them apart from empty values. NoSuchObject and NoSuchInstance values are nil, hence null as well.
+func (r metricsReading) jsonValue(fullOid string) interface{} {
+	if _, found := r.typesByQueryOids[fullOid]; !found {
+		return nil
+	}
+
+	return toJsonValue(r.valuesByQueryOids[fullOid])
+}
+
+// Octet strings are returned by gosnmp as byte slices which would otherwise be base64 encoded
+func toJsonValue(rawValue interface{}) interface{} {
+	octets, castOk := rawValue.([]uint8)
+	if !castOk {
+		return rawValue
+	}
+
+	return octetString(octets)
+}
+
+// Vendors pad sysDescr with nulls and line breaks, which are dropped so it fits on one line.
+func printableString(octets []uint8) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\r' || r == '\t' {
+			return ' '
+		} else if !unicode.IsPrint(r) {
+			return -1
+		}
+
+		return r
+	}, string(octets)))
+}
+
+// Text up to the first null, or hex such as 0x0A1B when the agent returned binary content
+func octetString(octets []uint8) string {
+	var indexOfFirstNull = slices.Index(octets, 0)
+	if indexOfFirstNull >= 0 {
+		octets = octets[:indexOfFirstNull]
+	}
+
+	text := string(octets)
+	isPrintable := utf8.ValidString(text) && !strings.ContainsFunc(text, func(r rune) bool {
+		return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+	})
+	if !isPrintable {
+		return fmt.Sprintf("0x%X", octets)
+	}
+
+	return text
+}
+
+func findVdslPppAdress(client snmpWalker, vdslIfIndex string) string {
+	result, err := client.WalkAll(string(IpAddressIfIndex))
+	if err != nil {
+		return fmt.Sprintf("(error: %v)", err)
+	}
+
+	wantedIfIndex, err := strconv.ParseUint(vdslIfIndex, 10, 64)
+	if err != nil {
+		return fmt.Sprintf("(error: invalid ifIndex %s)", vdslIfIndex)
+	}
+
+	for _, result := range result {
+		foundIfIndex, castOk := toUint64(result.Value)
+		if !castOk || foundIfIndex != wantedIfIndex {
+			continue
+		}
+
+		// ipAdEntIfIndex is indexed by the address itself, e.g. .1.3.6.1.2.1.4.20.1.2.10.0.0.1
+		addressSuffix, found := strings.CutPrefix(
+			strings.TrimPrefix(result.Name, "."), strings.TrimPrefix(string(IpAddressIfIndex), ".")+".")
+		if !found {
+			continue
+		}
+
+		ipAddress := net.ParseIP(addressSuffix)
+		if ipAddress != nil && ipAddress.To4() != nil {
+			return ipAddress.String()
+		}
+	}
+
+	return "(not found)"
+}
+
+var metricSlugReplacer = regexp.MustCompile("[^a-z0-9]+")
+
+// e.g. "Errored seconds, 1 day" becomes errored_seconds_1_day
+func metricSlug(item oidMetadata) string {
+	return strings.Trim(metricSlugReplacer.ReplaceAllString(strings.ToLower(item.name()), "_"), "_")
+}
+
+func prometheusMetricName(item oidMetadata) string {
+	return "vdsl_" + metricSlug(item)
+}
+
+// Prometheus text exposition format, only numeric values are exported
+func (s *Svc) HandlePrometheusRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	return prometheusResponse(ctx, target)
+}
+
+// Blackbox style scraping like the SNMP exporter, /metrics?target=<ip>&community=<c>, optionally with
+// format=prometheus. Modems not given to -ip are read through a session built for the request, only
+// with -allow-target-override.
+func (s *Svc) HandleMetricsRequest(ctx *gserv.Context) gserv.Response {
+	if format := ctx.Req.URL.Query().Get("format"); format != "" && format != prometheusFormat {
+		return gserv.CachedResponse(http.StatusBadRequest, "text/plain", fmt.Sprintf("unsupported format %q", format))
+	}
+
+	requestedTarget := ctx.Req.URL.Query().Get("target")
+	if requestedTarget == "" {
+		return gserv.CachedResponse(http.StatusBadRequest, "text/plain", "missing target")
+	}
+
+	address, err := parseSnmpAddress(requestedTarget)
+	if err != nil {
+		return gserv.CachedResponse(http.StatusBadRequest, "text/plain", fmt.Sprintf("invalid target %q", requestedTarget))
+	}
+
+	var target *snmpTarget
+	for _, configuredTarget := range s.targets {
+		if configuredTarget.address == address {
+			target = configuredTarget
+			break
+		}
+	}
+
+	if target == nil && !allowTargetOverride {
+		return unknownTargetResponse()
+	}
+
+	community := requestedCommunity(ctx)
+	if target == nil || community != "" {
+		throwawayTarget, err := newThrowawaySnmpTarget(address, snmpPort, cmp.Or(community, communities[0]))
+		if err != nil {
+			return gserv.CachedResponse(http.StatusBadGateway, "text/plain", fmt.Sprintf("snmp connect failed: %v", err))
+		}
+		defer throwawayTarget.close()
+
+		target = throwawayTarget
+	}
+
+	return prometheusResponse(ctx, target)
+}
+
+// Keyed by the normalized address so Prometheus servers spelling the target differently share the reading
+func metricsCacheKey(ctx *gserv.Context) string {
+	address, err := parseSnmpAddress(ctx.Req.URL.Query().Get("target"))
+	if err != nil {
+		return ""
+	}
+
+	return address + "/" + requestedIfIndex(ctx) + "/" + requestedCommunity(ctx) + "/" + ctx.Req.URL.Query().Get("format")
+}
+
+// The SNMP read is bounded by -request-timeout
+func prometheusResponse(ctx *gserv.Context, target *snmpTarget) gserv.Response {
+	readStart := time.Now()
+	reading := readRequestedMetrics(ctx, target)
+	readDuration := time.Since(readStart)
+
+	// Exporter health, served with a 200 even when SNMP fails so vdsl_up is 0 rather than absent
+	up := 0
+	if reading.succeeded() {
+		up = 1
+	}
+
+	var body strings.Builder
+	targetLabels := prometheusLabels("target", target.address)
+	body.WriteString("# HELP vdsl_up Whether the SNMP read of the modem succeeded\n# TYPE vdsl_up gauge\n")
+	_, _ = fmt.Fprintf(&body, "vdsl_up%s %d\n", targetLabels, up)
+	body.WriteString("# HELP vdsl_scrape_duration_seconds Time taken by the SNMP read of the modem\n# TYPE vdsl_scrape_duration_seconds gauge\n")
+	_, _ = fmt.Fprintf(&body, "vdsl_scrape_duration_seconds%s %s\n", targetLabels, strconv.FormatFloat(readDuration.Seconds(), 'f', 3, 64))
+
+	if !reading.succeeded() {
+		return gserv.PlainResponse("text/plain; version=0.0.4; charset=utf-8", body.String())
+	}
+
+	for _, item := range oidMetadataList {
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+
+		// Distinguishes the modems and lines when scraping several of them
+		labels := []string{"target", target.address}
+		if slices.ContainsFunc(item.fullOidTemplates, func(template string) bool {
+			return strings.Contains(template, "{IfIndex}") || strings.Contains(template, "ProfileIndex}")
+		}) {
+			labels = append(labels, "ifindex", reading.vdslIfIndex)
+		}
+
+		var samples []string
+		if len(expectedFullOids) == 2 {
+			samples = appendPrometheusSample(samples, prometheusLabels(append(labels, "direction", "down")...), reading.valuesByQueryOids[expectedFullOids[0]])
+			samples = appendPrometheusSample(samples, prometheusLabels(append(labels, "direction", "up")...), reading.valuesByQueryOids[expectedFullOids[1]])
+		} else if len(expectedFullOids) == 1 {
+			samples = appendPrometheusSample(samples, prometheusLabels(labels...), reading.valuesByQueryOids[expectedFullOids[0]])
+		}
+
+		if len(samples) == 0 {
+			continue
+		}
+
+		metricType := "gauge"
+		if item.isCounter {
+			metricType = "counter"
+		}
+
+		metricName := prometheusMetricName(item)
+		_, _ = fmt.Fprintf(&body, "# HELP %s %s\n# TYPE %s %s\n", metricName, item.name(), metricName, metricType)
+		for _, sample := range samples {
+			_, _ = fmt.Fprintf(&body, "%s%s\n", metricName, sample)
+		}
+	}
+
+	return gserv.PlainResponse("text/plain; version=0.0.4; charset=utf-8", body.String())
+}
+
+var prometheusLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Formats name and value pairs as {name="value",...}
+func prometheusLabels(namesAndValues ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, namesAndValues[i], prometheusLabelValueEscaper.Replace(namesAndValues[i+1])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Samples are returned without the metric name, as "{labels} value"
+func appendPrometheusSample(samples []string, labels string, rawValue interface{}) []string {
+	if _, castOk := toUint64(rawValue); castOk {
+		return append(samples, fmt.Sprintf("%s %d", labels, rawValue))
+	}
+
+	return samples
+}
+
+// key=value lines for shell scripts, e.g. snr_margin_down=6, only numeric values are included
+func (s *Svc) HandleTextRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	reading := readRequestedMetrics(ctx, target)
+	if !reading.succeeded() {
+		return gserv.CachedResponse(http.StatusServiceUnavailable, "text/plain", "snmp unavailable")
+	}
+
+	var body strings.Builder
+	writeLine := func(key string, rawValue interface{}) {
+		if value, castOk := toInt64(rawValue); castOk {
+			_, _ = fmt.Fprintf(&body, "%s=%d\n", key, value)
+		}
+	}
+
+	for _, item := range oidMetadataList {
+		key := metricSlug(item)
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 2 {
+			writeLine(key+"_down", reading.valuesByQueryOids[expectedFullOids[0]])
+			writeLine(key+"_up", reading.valuesByQueryOids[expectedFullOids[1]])
+		} else if len(expectedFullOids) == 1 {
+			writeLine(key, reading.valuesByQueryOids[expectedFullOids[0]])
+		}
+	}
+
+	return gserv.PlainResponse("text/plain; charset=utf-8", body.String())
+}
+
+var influxKeyEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+var influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+
+func (s *Svc) HandleInfluxRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	reading := readRequestedMetrics(ctx, target)
+	if !reading.succeeded() {
+		return gserv.CachedResponse(http.StatusServiceUnavailable, "text/plain", "snmp unavailable")
+	}
+
+	var fields, downstreamFields, upstreamFields []string
+	for _, item := range oidMetadataList {
+		fieldKey := influxKeyEscaper.Replace(item.name())
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 2 {
+			downstreamFields = appendInfluxField(downstreamFields, fieldKey, reading.valuesByQueryOids[expectedFullOids[0]])
+			upstreamFields = appendInfluxField(upstreamFields, fieldKey, reading.valuesByQueryOids[expectedFullOids[1]])
+		} else if len(expectedFullOids) == 1 {
+			fields = appendInfluxField(fields, fieldKey, reading.valuesByQueryOids[expectedFullOids[0]])
+		}
+	}
+
+	var body strings.Builder
+	writeLine := func(tags string, fields []string) {
+		if len(fields) > 0 {
+			_, _ = fmt.Fprintf(&body, "vdsl,%s %s %d\n", tags, strings.Join(fields, ","), reading.time.UnixNano())
+		}
+	}
+
+	targetTag := "target=" + influxKeyEscaper.Replace(target.address) + ",ifindex=" + influxKeyEscaper.Replace(reading.vdslIfIndex)
+	writeLine(targetTag, fields)
+	writeLine(targetTag+",direction=down", downstreamFields)
+	writeLine(targetTag+",direction=up", upstreamFields)
+
+	return gserv.PlainResponse("text/plain; charset=utf-8", body.String())
+}
+
+func (s *Svc) HandleCsvRequest(ctx *gserv.Context) gserv.Response {
+	target, release, errorResponse := s.resolveTarget(ctx)
+	if errorResponse != nil {
+		return errorResponse
+	}
+	defer release()
+
+	reading := readRequestedMetrics(ctx, target)
+	if !reading.succeeded() {
+		return gserv.CachedResponse(http.StatusServiceUnavailable, "text/plain", "snmp unavailable")
+	}
+
+	header := []string{"Time"}
+	row := []string{reading.time.Format(time.RFC3339)}
+	for _, item := range oidMetadataList {
+		expectedFullOids := reading.fullOidsByOidPrefix[item.oidPrefix]
+		if len(expectedFullOids) == 2 {
+			header = append(header, item.name()+" (down)", item.name()+" (up)")
+			row = append(row,
+				plainValue(reading.valuesByQueryOids[expectedFullOids[0]]),
+				plainValue(reading.valuesByQueryOids[expectedFullOids[1]]))
+		} else if len(expectedFullOids) == 1 {
+			header = append(header, item.description)
+			row = append(row, plainValue(reading.valuesByQueryOids[expectedFullOids[0]]))
+		}
+	}
+
+	var body bytes.Buffer
+	writer := csv.NewWriter(&body)
+	_ = writer.WriteAll([][]string{header, row})
+
+	ctx.Header().Set("Content-Disposition", `attachment; filename="vdsl-stats.csv"`)
+
+	return gserv.PlainResponse("text/csv; charset=utf-8", body.String())
+}
+
+// Raw values rather than formatted ones so they can be charted, empty when missing
+func plainValue(rawValue interface{}) string {
+	if _, castOk := toUint64(rawValue); castOk {
+		return fmt.Sprintf("%d", rawValue)
+	}
+
+	if octets, castOk := rawValue.([]uint8); castOk {
+		return octetString(octets)
+	}
+
+	return ""
+}
+
+// Values missing from the SNMP response are left out rather than written as empty fields
+func appendInfluxField(fields []string, fieldKey string, rawValue interface{}) []string {
+	if integerValue, castOk := toInt64(rawValue); castOk {
+		return append(fields, fmt.Sprintf("%s=%di", fieldKey, integerValue))
+	}
+
+	if octets, castOk := rawValue.([]uint8); castOk {
+		return append(fields, fmt.Sprintf(`%s="%s"`, fieldKey, influxStringEscaper.Replace(octetString(octets))))
+	}
+
+	return fields
+}
+
+// Turns a panic in handler, e.g. a formatter choking on an unexpected value, into a 500
+// response so it doesn't take the whole process down
+func CreateRecoverHandler(handler func(*gserv.Context) gserv.Response) func(*gserv.Context) gserv.Response {
+	return func(ctx *gserv.Context) (response gserv.Response) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Printf("Panic while serving %s: %v\n%s", ctx.Req.URL, recovered, debug.Stack())
+				response = gserv.CachedResponse(http.StatusInternalServerError, "text/plain", "internal error")
+			}
+		}()
+
+		return handler(ctx)
+	}
+}
+
+// Logs every request with the handler duration, which includes the SNMP queries but not the time
+// taken to send a returned response to the client.
+func CreateRequestLogHandler(enabled bool, handler func(*gserv.Context) gserv.Response) func(*gserv.Context) gserv.Response {
+	if !enabled {
+		return handler
+	}
+
+	return func(ctx *gserv.Context) gserv.Response {
+		start := time.Now()
+
+		// Responses written by the handler itself (streamed or compressed) are returned as nil
+		writer := &statusRecordingWriter{ResponseWriter: ctx.ResponseWriter, status: http.StatusOK}
+		ctx.ResponseWriter = writer
+
+		response := handler(ctx)
+
+		status := writer.status
+		if response != nil {
+			status = response.Status()
+		}
+
+		log.Printf("%s %s %d %v", ctx.Req.Method, ctx.Req.URL.Path, status, time.Since(start))
+
+		return response
+	}
+}
+
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Lets http.NewResponseController reach the Flusher of the underlying writer
+func (w *statusRecordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Compresses responses on their way out, after the cache: cached responses are stored
+// uncompressed once and served to clients with and without gzip support alike.
+func CreateGzipHandler(handler func(*gserv.Context) gserv.Response) func(*gserv.Context) gserv.Response {
+	return func(ctx *gserv.Context) gserv.Response {
+		response := handler(ctx)
+
+		// Streamed responses are already written and return nil
+		ctx.Header().Add("Vary", "Accept-Encoding")
+		if response == nil || !acceptsGzip(ctx.Req) {
+			return response
+		}
+
+		ctx.Header().Set("Content-Encoding", "gzip")
+		ctx.Header().Del("Content-Length")
+
+		uncompressedWriter := ctx.ResponseWriter
+		gzipWriter := gzip.NewWriter(uncompressedWriter)
+		ctx.ResponseWriter = gzipResponseWriter{uncompressedWriter, gzipWriter}
+		defer func() { ctx.ResponseWriter = uncompressedWriter }()
+
+		err := response.WriteToCtx(ctx)
+		if err == nil {
+			err = gzipWriter.Close()
+		}
+
+		if err != nil {
+			log.Printf("Failed to write gzip response to %s: %v", ctx.Req.RemoteAddr, err)
+		}
+
+		return nil
+	}
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer io.Writer
+}
+
+func (w gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+func acceptsGzip(req *http.Request) bool {
+	for _, encoding := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if strings.TrimSpace(name) == "gzip" {
+			quality, err := strconv.ParseFloat(strings.TrimPrefix(strings.TrimSpace(params), "q="), 64)
+			return params == "" || err != nil || quality > 0
+		}
+	}
+
+	return false
+}
+
+type cacheEntry struct {
+	key      string
+	response gserv.Response
+	time     time.Time
+}
+
+// Requests for a key being read wait for its response rather than reading the modem again
+type cacheRead struct {
+	response gserv.Response
+	done     chan struct{}
+}
+
+// Bounds the memory used by cache keys built from query parameters such as ?target= and ?ifindex=
+const maxCacheEntries = 64
+
+func CreateCacheHandler(cacheDuration time.Duration, cacheKey func(*gserv.Context) string, handler func(*gserv.Context) gserv.Response) func(*gserv.Context) gserv.Response {
+	if cacheDuration <= 0 {
+		return handler
+	}
+
+	// Guards the maps and the list, it isn't held while the handler reads the modem so a slow
+	// or dead one doesn't hold up the other keys
+	var cacheMutex sync.Mutex
+
+	// Most recently used entries are at the front of the list
+	cacheEntries := make(map[string]*list.Element)
+	recentlyUsed := list.New()
+	readsByKey := make(map[string]*cacheRead)
+
+	return func(ctx *gserv.Context) gserv.Response {
+		key := cacheKey(ctx)
+
+		cacheMutex.Lock()
+		element, found := cacheEntries[key]
+		if found {
+			entry := element.Value.(*cacheEntry)
+			if time.Since(entry.time) < cacheDuration {
+				recentlyUsed.MoveToFront(element)
+				cacheMutex.Unlock()
+				return entry.response
+			}
+
+			recentlyUsed.Remove(element)
+			delete(cacheEntries, key)
+		}
+
+		if read, found := readsByKey[key]; found {
+			cacheMutex.Unlock()
+			<-read.done
+			return read.response
+		}
+
+		// Served to the waiting requests if the handler panics
+		read := &cacheRead{
+			response: gserv.CachedResponse(http.StatusInternalServerError, "text/plain", "internal error"),
+			done:     make(chan struct{}),
+		}
+		readsByKey[key] = read
+		cacheMutex.Unlock()
+
+		defer func() {
+			cacheMutex.Lock()
+			defer cacheMutex.Unlock()
+
+			delete(readsByKey, key)
+			close(read.done)
+
+			// Errors aren't cached so the next request retries the modem straight away
+			if read.response.Status() >= http.StatusBadRequest {
+				return
+			}
+
+			cacheEntries[key] = recentlyUsed.PushFront(&cacheEntry{key, read.response, time.Now()})
+			for recentlyUsed.Len() > maxCacheEntries {
+				oldest := recentlyUsed.Back()
+				recentlyUsed.Remove(oldest)
+				delete(cacheEntries, oldest.Value.(*cacheEntry).key)
+			}
+		}()
+
+		read.response = handler(ctx)
+
+		return read.response
+	}
+}
+
+func CreateBasicAuthHandler(user string, password string, handler func(*gserv.Context) gserv.Response) func(*gserv.Context) gserv.Response {
+	if user == "" {
+		return handler
+	}
+
+	return func(ctx *gserv.Context) gserv.Response {
+		requestUser, requestPassword, found := ctx.Req.BasicAuth()
+
+		// Both comparisons always run so the response time doesn't reveal which one failed
+		userMatches := subtle.ConstantTimeCompare([]byte(requestUser), []byte(user))
+		passwordMatches := subtle.ConstantTimeCompare([]byte(requestPassword), []byte(password))
+		if !found || userMatches&passwordMatches != 1 {
+			ctx.Header().Set("WWW-Authenticate", `Basic realm="VDSL Statistics", charset="UTF-8"`)
+			return gserv.CachedResponse(http.StatusUnauthorized, "text/plain", "unauthorized")
+		}
 
-		return newResponse
+		return handler(ctx)
 	}
 }